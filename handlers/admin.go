@@ -0,0 +1,154 @@
+package handlers
+
+import (
+  "context"
+  "net/http"
+  "net/url"
+  "os"
+  "sort"
+  "sync"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+type ProviderStatus struct {
+  Company string `json:"company"`
+  KeyEnv string `json:"key_env,omitempty"`
+  Configured bool `json:"configured"`
+  Keys []ProviderKeyStatus `json:"keys,omitempty"`
+}
+
+// ProviderKeyStatus is the pool state of one key plus the result of checking it
+type ProviderKeyStatus struct {
+  KeyStatus
+  Valid *bool `json:"valid,omitempty"`
+  StatusCode int `json:"status_code,omitempty"`
+  Error string `json:"error,omitempty"`
+}
+
+// AdminAuth only lets through requests carrying ADMIN_API_KEY in X-Admin-Key
+func AdminAuth(c *fiber.Ctx) error {
+  if os.Getenv("ADMIN_API_KEY") == "" {
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "ADMIN_API_KEY is not set",
+    })
+  }
+
+  if !validAdminKey(c) {
+    return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+      "error": "Invalid admin credentials",
+    })
+  }
+
+  return c.Next()
+}
+
+func DiagnosticsHandler(c *fiber.Ctx) error {
+  // Check every registered provider in parallel
+  var companies []string
+  for company := range providers {
+    companies = append(companies, company)
+  }
+  sort.Strings(companies)
+
+  statuses := make([]ProviderStatus, len(companies))
+  var wg sync.WaitGroup
+  for i, company := range companies {
+    wg.Add(1)
+    go func(i int, company string) {
+      defer wg.Done()
+      statuses[i] = providerStatus(company, providers[company])
+    }(i, company)
+  }
+  wg.Wait()
+
+  // Report the catalog in use and whether the latest edit was rejected
+  catalog := currentCatalog()
+  models := fiber.Map{
+    "path": modelCatalogPath,
+    "version": catalog.Version,
+    "modified": catalog.Modified.UTC().Format(time.RFC3339),
+    "loaded": catalog.Loaded.UTC().Format(time.RFC3339),
+  }
+  if err := lastCatalogError(); err != "" {
+    models["error"] = err
+  }
+
+  // Ping MongoDB
+  mongo := fiber.Map{"connected": true}
+  ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+  defer cancel()
+  if err := userCollection.Database().Client().Ping(ctx, readpref.Primary()); err != nil {
+    mongo["connected"] = false
+    mongo["error"] = err.Error()
+  }
+
+  return c.JSON(fiber.Map{
+    "providers": statuses,
+    "models": models,
+    "mongodb": mongo,
+  })
+}
+
+func providerStatus(company string, provider Provider) ProviderStatus {
+  status := ProviderStatus{Company: company}
+
+  keyed, ok := provider.(KeyedProvider)
+  if !ok {
+    return status
+  }
+
+  status.KeyEnv = keyed.APIKeyEnv()
+  pool := getKeyPool(company)
+  keys := pool.secrets()
+  if len(keys) == 0 {
+    return status
+  }
+  status.Configured = true
+
+  // Check every key of the pool, the secrets never leave this function
+  status.Keys = make([]ProviderKeyStatus, len(keys))
+  var wg sync.WaitGroup
+  for i, key := range pool.statuses() {
+    status.Keys[i].KeyStatus = key
+    wg.Add(1)
+    go func(i int, secret string) {
+      defer wg.Done()
+      statusCode, err := keyed.CheckAPIKey(secret)
+      if err != nil {
+        status.Keys[i].Error = err.Error()
+        return
+      }
+      valid := statusCode == http.StatusOK
+      status.Keys[i].Valid = &valid
+      status.Keys[i].StatusCode = statusCode
+    }(i, keys[i].Secret)
+  }
+  wg.Wait()
+  return status
+}
+
+// maskKey only keeps the last 4 characters of a secret
+func maskKey(key string) string {
+  if len(key) <= 4 {
+    return "****"
+  }
+  return "****" + key[len(key)-4:]
+}
+
+func checkKeyRequest(req *http.Request) (int, error) {
+  client := &http.Client{Timeout: 10 * time.Second}
+  resp, err := client.Do(req)
+  if err != nil {
+    // Drop the URL from the error, Gemini carries the key in the query
+    if urlErr, ok := err.(*url.Error); ok {
+      return 0, urlErr.Err
+    }
+    return 0, err
+  }
+  defer resp.Body.Close()
+
+  return resp.StatusCode, nil
+}
@@ -1,82 +1,291 @@
 package handlers
 
 import (
-  "github.com/gofiber/fiber/v2"
   "bytes"
+  "context"
   "encoding/json"
-  "io/ioutil"
+  "errors"
   "net/http"
-  "os"
-)
+  "strings"
 
-type ANTMessage struct {
-  Role string `json:"role"`
-  Content string `json:"content"`
-}
-
-type ANTRequestBody struct {
-  Model string `json:"model"`
-  MaxTokens int `json:"max_tokens"`
-  Messages []ANTMessage `json:"messages"`
-}
+  "github.com/gofiber/fiber/v2"
+)
 
-func AnthropicHandler(c *fiber.Ctx) error {
-  // Read request body
-  var requestBody ANTRequestBody
-  if err := c.BodyParser(&requestBody); err != nil {
-    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-      "error": "Cannot parse JSON",
-    })
-  }
+// Anthropic requires max_tokens on every request, this is used for models
+// without max_output_tokens in the catalog
+const anthropicMaxTokens = 4096
 
-  // Set the Anthropic API key and endpoint
-  ANTKey := os.Getenv("CLAUDE_API_KEY")
-  if ANTKey == "" {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "CLAUDE_API_KEY is not set",
-    })
+func newAnthropicRequest(requestBody ANTRequestBody) (*http.Request, error) {
+  // Check the Anthropic API keys and set the endpoint, the key is added per attempt
+  if !getKeyPool("anthropic").configured() {
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "CLAUDE_API_KEY is not set")
   }
-  url := "https://api.anthropic.com/v1/messages"
+  url := upstreamURL("anthropic", "/v1/messages")
 
   // Convert request body to JSON
   jsonBody, err := json.Marshal(requestBody)
   if err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error marshalling JSON",
-    })
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error marshalling JSON")
   }
 
   // Make HTTP request
   req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
   if err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error creating request",
-    })
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
   }
 
   // Add headers
-  req.Header.Set("x-api-key", ANTKey)
   req.Header.Set("anthropic-version", "2023-06-01")
   req.Header.Set("Content-Type", "application/json")
 
+  return req, nil
+}
+
+func AnthropicResponseJSON(ctx context.Context, requestBody ANTRequestBody) ([]byte, int, error) {
+  req, err := newAnthropicRequest(requestBody)
+  if err != nil {
+    return nil, http.StatusInternalServerError, err
+  }
+
+  // Send request
+  return upstreamCall(ctx, "anthropic", req)
+}
+
+// AnthropicStream opens a messages event stream, the caller closes the body
+func AnthropicStream(ctx context.Context, requestBody ANTRequestBody) (*http.Response, error) {
+  req, err := newAnthropicRequest(requestBody)
+  if err != nil {
+    return nil, err
+  }
+
   // Send request
-  client := &http.Client{}
-  resp, err := client.Do(req)
+  return upstreamStream(ctx, "anthropic", req)
+}
+
+type anthropicProvider struct{}
+
+func (anthropicProvider) BuildRequest(body RequestBody) (interface{}, error) {
+  // Split the system prompt from the conversation
+  system, anthropicMessages, err := processAnthropicRequest(body)
   if err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error sending request",
-    })
+    return nil, err
+  }
+  generation, err := body.generation("anthropic", anthropicGeneration)
+  if err != nil {
+    return nil, err
+  }
+  maxTokens := anthropicMaxTokensFor(body.Model)
+  if generation.MaxTokens != nil {
+    maxTokens = *generation.MaxTokens
+  }
+
+  // Create Anthropic request body
+  antRequestBody := ANTRequestBody{
+    Model: body.Model,
+    MaxTokens: maxTokens,
+    System: system,
+    Messages: anthropicMessages,
+    Temperature: generation.Temperature,
+    TopP: generation.TopP,
+    StopSequences: generation.Stop,
+    Stream: body.Stream != nil && *body.Stream,
+  }
+  antRequestBody.Tools, antRequestBody.ToolChoice = anthropicTools(body)
+
+  // Claude has no JSON mode, a schema is enforced by forcing a tool call
+  if schema := body.OutputSchema; schema != nil {
+    antRequestBody.Tools = []ANTTool{{
+      Name: schema.name(),
+      Description: "Respond by calling this tool with the answer as its input",
+      InputSchema: schema.Schema,
+    }}
+    antRequestBody.ToolChoice = &ANTToolChoice{Type: "tool", Name: schema.name()}
+  }
+
+  return antRequestBody, nil
+}
+
+func (anthropicProvider) Call(ctx context.Context, payload interface{}) ([]byte, int, error) {
+  return AnthropicResponseJSON(ctx, payload.(ANTRequestBody))
+}
+
+// input_tokens excludes the tokens read from or written to the prompt cache
+type anthropicUsage struct {
+  InputTokens int `json:"input_tokens"`
+  OutputTokens int `json:"output_tokens"`
+  CacheReadInputTokens int `json:"cache_read_input_tokens"`
+  CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+}
+
+func (usage anthropicUsage) tokenUsage() TokenUsage {
+  return TokenUsage{
+    InputTokens: usage.InputTokens,
+    OutputTokens: usage.OutputTokens,
+    CachedInputTokens: usage.CacheReadInputTokens,
+    CacheWriteTokens: usage.CacheCreationInputTokens,
+  }
+}
+
+// promptTokens counts every input token, as OpenAI's prompt_tokens does
+func (usage anthropicUsage) promptTokens() int {
+  return usage.InputTokens + usage.CacheReadInputTokens + usage.CacheCreationInputTokens
+}
+
+func (anthropicProvider) ParseUsage(response []byte) (TokenUsage, error) {
+  var anthropicResponse struct {
+    Usage anthropicUsage `json:"usage"`
+  }
+  if err := json.Unmarshal(response, &anthropicResponse); err != nil {
+    return TokenUsage{}, err
+  }
+
+  return anthropicResponse.Usage.tokenUsage(), nil
+}
+
+func (anthropicProvider) Stream(ctx context.Context, payload interface{}) (*http.Response, error) {
+  return AnthropicStream(ctx, payload.(ANTRequestBody))
+}
+
+// Input tokens arrive in message_start, output tokens in each message_delta
+func (anthropicProvider) ParseStreamUsage(data []byte, usage *TokenUsage) {
+  var event struct {
+    Type string `json:"type"`
+    Message struct {
+      Usage anthropicUsage `json:"usage"`
+    } `json:"message"`
+    Usage struct {
+      OutputTokens int `json:"output_tokens"`
+    } `json:"usage"`
+  }
+  if err := json.Unmarshal(data, &event); err != nil {
+    return
   }
-  defer resp.Body.Close()
 
-  // Read response
-  body, err := ioutil.ReadAll(resp.Body)
+  switch event.Type {
+  case "message_start":
+    *usage = event.Message.Usage.tokenUsage()
+  case "message_delta":
+    usage.OutputTokens = event.Usage.OutputTokens
+  }
+}
+
+// The output is the input of the forced tool call
+func (anthropicProvider) StructuredOutput(response []byte) (string, error) {
+  var anthropicResponse struct {
+    Content []ANTBlock `json:"content"`
+  }
+  if err := json.Unmarshal(response, &anthropicResponse); err != nil {
+    return "", errors.New("the response has no output")
+  }
+
+  var text strings.Builder
+  for _, block := range anthropicResponse.Content {
+    if block.Type == "tool_use" {
+      return string(block.Input), nil
+    }
+    text.WriteString(block.Text)
+  }
+  return text.String(), nil
+}
+
+func (anthropicProvider) APIKeyEnv() string {
+  return "CLAUDE_API_KEY"
+}
+
+func (anthropicProvider) Authorize(req *http.Request, key string) {
+  req.Header.Set("x-api-key", key)
+}
+
+// Listing models is free, so it is used to validate the key
+func (provider anthropicProvider) CheckAPIKey(key string) (int, error) {
+  req, err := http.NewRequest("GET", upstreamURL("anthropic", "/v1/models?limit=1"), nil)
   if err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error reading response",
-    })
+    return 0, err
+  }
+  provider.Authorize(req, key)
+  req.Header.Set("anthropic-version", "2023-06-01")
+
+  return checkKeyRequest(req)
+}
+
+// Anthropic stop reasons in OpenAI's finish_reason vocabulary
+func anthropicFinishReason(stopReason string) string {
+  switch stopReason {
+  case "":
+    return ""
+  case "max_tokens":
+    return "length"
+  case "tool_use":
+    return "tool_calls"
+  default:
+    return "stop"
+  }
+}
+
+func (anthropicProvider) TranslateResponse(response []byte) (ChatCompletion, error) {
+  var anthropicResponse struct {
+    Content []ANTBlock `json:"content"`
+    StopReason string `json:"stop_reason"`
+    Usage anthropicUsage `json:"usage"`
+  }
+  if err := json.Unmarshal(response, &anthropicResponse); err != nil {
+    return ChatCompletion{}, err
+  }
+
+  var text strings.Builder
+  for _, block := range anthropicResponse.Content {
+    if block.Type == "text" {
+      text.WriteString(block.Text)
+    }
+  }
+
+  return newChatCompletion(text.String(), anthropicToolCalls(anthropicResponse.Content), anthropicFinishReason(anthropicResponse.StopReason), ChatUsage{
+    PromptTokens: anthropicResponse.Usage.promptTokens(),
+    CompletionTokens: anthropicResponse.Usage.OutputTokens,
+  }), nil
+}
+
+// Text and tool arguments arrive in content_block_delta events, a tool_use
+// block starts with its id and name, the stop reason comes in message_delta
+func (anthropicProvider) TranslateEvent(data []byte) (ChatDelta, string) {
+  var event struct {
+    Type string `json:"type"`
+    Index int `json:"index"`
+    ContentBlock ANTBlock `json:"content_block"`
+    Delta struct {
+      Type string `json:"type"`
+      Text string `json:"text"`
+      PartialJSON string `json:"partial_json"`
+      StopReason string `json:"stop_reason"`
+    } `json:"delta"`
+  }
+  if err := json.Unmarshal(data, &event); err != nil {
+    return ChatDelta{}, ""
   }
 
-  // Return response client
-  return c.Status(resp.StatusCode).Send(body)
+  switch event.Type {
+  case "content_block_start":
+    if event.ContentBlock.Type == "tool_use" {
+      return ChatDelta{ToolCalls: []ToolCall{{
+        Index: &event.Index,
+        ID: event.ContentBlock.ID,
+        Type: "function",
+        Function: ToolCallFunction{Name: event.ContentBlock.Name},
+      }}}, ""
+    }
+  case "content_block_delta":
+    if event.Delta.Type == "input_json_delta" {
+      if event.Delta.PartialJSON == "" {
+        return ChatDelta{}, ""
+      }
+      return ChatDelta{ToolCalls: []ToolCall{{
+        Index: &event.Index,
+        Function: ToolCallFunction{Arguments: event.Delta.PartialJSON},
+      }}}, ""
+    }
+    return ChatDelta{Content: event.Delta.Text}, ""
+  case "message_delta":
+    return ChatDelta{}, anthropicFinishReason(event.Delta.StopReason)
+  }
+  return ChatDelta{}, ""
 }
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "log"
+  "os"
+  "strings"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Keys look like agpt_<48 hex chars>, the prefix identifies them for revocation
+const (
+  apiKeyScheme = "agpt_"
+  apiKeyPrefixLength = 12
+)
+
+type APIKey struct {
+  Prefix string `json:"prefix" bson:"prefix"`
+  Hash string `json:"-" bson:"hash"`
+  Created int64 `json:"created" bson:"created"`
+}
+
+// UserAuth resolves the Bearer API key to its user. Requests with a valid
+// X-Admin-Key skip it and may act on behalf of the id_user in the body.
+func UserAuth(c *fiber.Ctx) error {
+  if validAdminKey(c) {
+    c.Locals("admin", true)
+    return c.Next()
+  }
+
+  token, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+  if !found || token == "" {
+    return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+      "error": "Missing API key",
+    })
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  var user struct {
+    ID string `bson:"id_user"`
+  }
+  err := userCollection.FindOne(ctx, bson.M{"api_keys.hash": hashAPIKey(token)}).Decode(&user)
+  if err != nil {
+    if err != mongo.ErrNoDocuments {
+      log.Printf("%v", err)
+    }
+    return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+      "error": "Invalid API key",
+    })
+  }
+
+  c.Locals("id_user", user.ID)
+  return c.Next()
+}
+
+// requestUserID returns the authenticated user, or the body's id_user for admins
+func requestUserID(c *fiber.Ctx, bodyUserID string) string {
+  if userID, ok := c.Locals("id_user").(string); ok {
+    return userID
+  }
+  if admin, _ := c.Locals("admin").(bool); admin {
+    return bodyUserID
+  }
+  return ""
+}
+
+func validAdminKey(c *fiber.Ctx) bool {
+  adminKey := os.Getenv("ADMIN_API_KEY")
+  if adminKey == "" {
+    return false
+  }
+  return subtle.ConstantTimeCompare([]byte(c.Get("X-Admin-Key")), []byte(adminKey)) == 1
+}
+
+func hashAPIKey(key string) string {
+  digest := sha256.Sum256([]byte(key))
+  return hex.EncodeToString(digest[:])
+}
+
+// CreateAPIKeyHandler issues a new key for the user, it is only shown once
+func CreateAPIKeyHandler(c *fiber.Ctx) error {
+  secret := make([]byte, 24)
+  if _, err := rand.Read(secret); err != nil {
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error generating API key",
+    })
+  }
+  key := apiKeyScheme + hex.EncodeToString(secret)
+
+  apiKey := APIKey{
+    Prefix: key[:apiKeyPrefixLength],
+    Hash: hashAPIKey(key),
+    Created: time.Now().Unix(),
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  result, err := userCollection.UpdateOne(ctx, bson.M{"id_user": c.Params("id")}, bson.M{
+    "$push": bson.M{"api_keys": apiKey},
+  })
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+  if result.MatchedCount == 0 {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "User not found",
+    })
+  }
+
+  return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+    "id_user": c.Params("id"),
+    "key": key,
+    "prefix": apiKey.Prefix,
+    "created": apiKey.Created,
+  })
+}
+
+func RevokeAPIKeyHandler(c *fiber.Ctx) error {
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  result, err := userCollection.UpdateOne(ctx, bson.M{"id_user": c.Params("id"), "api_keys.prefix": c.Params("prefix")}, bson.M{
+    "$pull": bson.M{"api_keys": bson.M{"prefix": c.Params("prefix")}},
+  })
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+  if result.MatchedCount == 0 {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "API key not found",
+    })
+  }
+
+  return c.SendStatus(fiber.StatusNoContent)
+}
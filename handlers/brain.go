@@ -2,33 +2,205 @@ package handlers
 
 import (
   "github.com/gofiber/fiber/v2"
-  "os"
-  "fmt"
+  "sort"
+  "time"
 )
 
-func OpenAIBrain(c *fiber.Ctx) error {
-  OAIKey := os.Getenv("OPENAI_API_KEY")
-  GKey := os.Getenv("GEMINI_API_KEY")
-  ANTKey := os.Getenv("CLAUDE_API_KEY")
+type BrainRequestBody struct {
+  RequestBody
+  Optimize string `json:"optimize,omitempty"`
+  MinScore map[string]float64 `json:"min_score,omitempty"`
+  MaxCostPerCall *float64 `json:"max_cost_per_call,omitempty"`
+  ExpectedOutputTokens int `json:"expected_output_tokens,omitempty"`
+}
+
+// How many of the next ranked models a /brain call may fall back to
+const maxBrainFallbacks = 2
 
-  response := "Still working on this route...\n"
+type brainCandidate struct {
+  Company string
+  Model string
+  Quality float64
+  Cost float64
+  Score float64
+}
+
+func BrainHandler(c *fiber.Ctx) error {
+  // Read request body
+  var requestBody BrainRequestBody
+  if err := c.BodyParser(&requestBody); err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "Cannot parse JSON",
+    })
+  }
 
-  if OAIKey == "" {
-    response += "OPENAI_API_KEY is not set"
-  } else {
-    response += fmt.Sprintf("OPENAI_API_KEY: %s", OAIKey)
+  switch requestBody.Optimize {
+  case "":
+    requestBody.Optimize = "balanced"
+  case "cost", "quality", "balanced":
+  default:
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "optimize must be one of cost, quality or balanced",
+    })
   }
-  if GKey == "" {
-    response += "\nGEMINI_API_KEY is not set"
-  } else {
-    response += fmt.Sprintf("\nGEMINI_API_KEY: %s", GKey)
+
+  ranked := routeModels(currentCatalog(), requestBody)
+  if len(ranked) == 0 {
+    return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+      "error": "No model satisfies the routing constraints",
+    })
   }
-  if ANTKey == "" {
-    response += "\nCLAUDE_API_KEY is not set"
-  } else {
-    response += fmt.Sprintf("\nCLAUDE_API_KEY: %s", ANTKey)
+  best := ranked[0]
+
+  // Report the routing decision before the response is written
+  c.Set("X-Brain-Provider", best.Company)
+  c.Set("X-Brain-Model", best.Model)
+
+  routed := requestBody.RequestBody
+  routed.Model = best.Model
+  fallback := brainFallback(ranked[1:], requestBody.Fallback)
+  routed.Fallback = &fallback
+  return handleCompletion(c, best.Company, routed, nil)
+}
+
+// brainFallback falls back along the next ranked models, so a fallback meets
+// the same constraints as the chosen model. A fallback list in the request
+// is kept to the models that meet them.
+func brainFallback(candidates []brainCandidate, requested *[]string) []string {
+  fallback := []string{}
+  if requested != nil {
+    for _, model := range *requested {
+      for _, candidate := range candidates {
+        if candidate.Model == model {
+          fallback = append(fallback, model)
+          break
+        }
+      }
+    }
+    return fallback
   }
-  
-  return c.SendString(response)
 
+  for _, candidate := range candidates {
+    if len(fallback) == maxBrainFallbacks {
+      break
+    }
+    fallback = append(fallback, candidate.Model)
+  }
+  return fallback
+}
+
+// routeModels ranks the registered models that fit the routing hints, best first
+func routeModels(catalog *ModelCatalog, body BrainRequestBody) []brainCandidate {
+  outputTokens := body.ExpectedOutputTokens
+  if outputTokens <= 0 {
+    outputTokens = estimatedOutputTokens
+  }
+
+  images := requestHasImages(body.RequestBody)
+  var candidates []brainCandidate
+  for company, companyModels := range catalog.Companies {
+    if _, ok := getProvider(company); !ok {
+      continue
+    }
+
+    for model, info := range companyModels.Models {
+      // Audio and embeddings models can't answer chat requests
+      if info.PricePerTokens == nil || !info.HasCapability("chat") {
+        continue
+      }
+      // Images need a model that can read them
+      if images && !info.HasCapability("vision") {
+        continue
+      }
+      // Avoid providers and models whose circuit breaker is open
+      if !breakerAvailable(company, model) {
+        continue
+      }
+      if !meetsMinScores(info, body.MinScore) {
+        continue
+      }
+
+      price := info.PriceAt(time.Now())
+      cost := estimateCost(body.RequestBody, outputTokens, price.Input, price.Output)
+      if body.MaxCostPerCall != nil && cost > *body.MaxCostPerCall {
+        continue
+      }
+
+      candidates = append(candidates, brainCandidate{
+        Company: company,
+        Model: model,
+        Quality: averageScore(info),
+        Cost: cost,
+      })
+    }
+  }
+
+  if len(candidates) == 0 {
+    return nil
+  }
+
+  // Normalise quality and cost to [0, 1] across the remaining candidates
+  minQuality, maxQuality := candidates[0].Quality, candidates[0].Quality
+  minCost, maxCost := candidates[0].Cost, candidates[0].Cost
+  for _, candidate := range candidates {
+    minQuality = min(minQuality, candidate.Quality)
+    maxQuality = max(maxQuality, candidate.Quality)
+    minCost = min(minCost, candidate.Cost)
+    maxCost = max(maxCost, candidate.Cost)
+  }
+
+  for i := range candidates {
+    quality := normalise(candidates[i].Quality, minQuality, maxQuality)
+    cheapness := 1 - normalise(candidates[i].Cost, minCost, maxCost)
+    switch body.Optimize {
+    case "cost":
+      candidates[i].Score = cheapness
+    case "quality":
+      candidates[i].Score = quality
+    default:
+      candidates[i].Score = (quality + cheapness) / 2
+    }
+  }
+
+  // Ties go to the cheaper model, then by name so routing is deterministic
+  sort.Slice(candidates, func(i, j int) bool {
+    if candidates[i].Score != candidates[j].Score {
+      return candidates[i].Score > candidates[j].Score
+    }
+    if candidates[i].Cost != candidates[j].Cost {
+      return candidates[i].Cost < candidates[j].Cost
+    }
+    return candidates[i].Company+candidates[i].Model < candidates[j].Company+candidates[j].Model
+  })
+
+  return candidates
+}
+
+func meetsMinScores(info ModelSpec, minScores map[string]float64) bool {
+  for benchmark, minScore := range minScores {
+    score, ok := info.BenchmarkScores[benchmark]
+    if !ok || score < minScore {
+      return false
+    }
+  }
+  return true
+}
+
+// Average of the published benchmark scores
+func averageScore(info ModelSpec) float64 {
+  if len(info.BenchmarkScores) == 0 {
+    return 0
+  }
+  total := 0.0
+  for _, score := range info.BenchmarkScores {
+    total += score
+  }
+  return total / float64(len(info.BenchmarkScores))
+}
+
+func normalise(value float64, low float64, high float64) float64 {
+  if high == low {
+    return 1
+  }
+  return (value - low) / (high - low)
 }
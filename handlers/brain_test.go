@@ -0,0 +1,76 @@
+package handlers
+
+import (
+  "reflect"
+  "testing"
+)
+
+func brainTestCatalog() *ModelCatalog {
+  model := func(input float64, output float64, humanEval float64) ModelSpec {
+    return ModelSpec{
+      Description: "test model",
+      Capabilities: []string{"chat"},
+      PricePerTokens: &TokenPrices{Input: input, Output: output},
+      BenchmarkScores: BenchmarkScores{"HumanEval": humanEval},
+    }
+  }
+  return &ModelCatalog{Companies: map[string]CompanyModels{
+    "openai": {Models: map[string]ModelSpec{
+      "brain-test-large": model(10, 30, 92),
+      "brain-test-small": model(0.15, 0.6, 87),
+    }},
+    "anthropic": {Models: map[string]ModelSpec{
+      "brain-test-mid": model(3, 15, 91),
+      "brain-test-tiny": model(0.25, 1.25, 75),
+    }},
+  }}
+}
+
+func brainModels(candidates []brainCandidate) []string {
+  models := []string{}
+  for _, candidate := range candidates {
+    models = append(models, candidate.Model)
+  }
+  return models
+}
+
+func TestRouteModelsRespectsConstraints(t *testing.T) {
+  prompt := "Write a haiku"
+  maxCost := 0.02
+  body := BrainRequestBody{
+    RequestBody: RequestBody{Prompt: &prompt},
+    Optimize: "quality",
+    MinScore: map[string]float64{"HumanEval": 80},
+    MaxCostPerCall: &maxCost,
+  }
+
+  ranked := routeModels(brainTestCatalog(), body)
+  if got, want := brainModels(ranked), []string{"brain-test-mid", "brain-test-small"}; !reflect.DeepEqual(got, want) {
+    t.Fatalf("ranked %v, want %v", got, want)
+  }
+  if got, want := brainFallback(ranked[1:], nil), []string{"brain-test-small"}; !reflect.DeepEqual(got, want) {
+    t.Errorf("fallback %v, want %v", got, want)
+  }
+}
+
+func TestBrainFallback(t *testing.T) {
+  candidates := []brainCandidate{{Model: "a"}, {Model: "b"}, {Model: "c"}, {Model: "d"}}
+  tests := []struct {
+    name string
+    requested *[]string
+    want []string
+  }{
+    {"next ranked", nil, []string{"a", "b"}},
+    {"disabled", &[]string{}, []string{}},
+    {"requested models meeting the hints", &[]string{"gpt-4o", "c", "a"}, []string{"c", "a"}},
+    {"requested models not meeting the hints", &[]string{"gpt-4o"}, []string{}},
+  }
+  for _, test := range tests {
+    if got := brainFallback(candidates, test.requested); !reflect.DeepEqual(got, test.want) {
+      t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+    }
+  }
+  if got := brainFallback(nil, nil); len(got) != 0 {
+    t.Errorf("no candidates: got %v", got)
+  }
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+  "sort"
+  "sync"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// Breaker thresholds, shared by the provider and model breakers
+const (
+  breakerConsecutiveFailures = 5
+  breakerWindowSize = 20
+  breakerMinRequests = 10
+  breakerErrorRate = 0.5
+  breakerOpenDuration = 30 * time.Second
+)
+
+const (
+  breakerClosed = "closed"
+  breakerOpen = "open"
+  breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker opens after too many consecutive failures or a high error
+// rate over the last calls, then lets a single probe through once the open
+// period is over to decide whether to close again
+type circuitBreaker struct {
+  mu sync.Mutex
+  state string
+  consecutiveFailures int
+  window []bool
+  next int
+  openedAt time.Time
+  probing bool
+}
+
+type BreakerStatus struct {
+  State string `json:"state"`
+  ConsecutiveFailures int `json:"consecutive_failures"`
+  ErrorRate float64 `json:"error_rate"`
+  Requests int `json:"requests"`
+  OpenedAt int64 `json:"opened_at,omitempty"`
+  RetryAt int64 `json:"retry_at,omitempty"`
+}
+
+// Breakers are kept in memory, the server runs as one process so every
+// request and /status see the same state
+var (
+  breakersMu sync.Mutex
+  providerBreakers = map[string]*circuitBreaker{}
+  modelBreakers = map[string]*circuitBreaker{}
+)
+
+func getBreaker(breakers map[string]*circuitBreaker, key string) *circuitBreaker {
+  breakersMu.Lock()
+  defer breakersMu.Unlock()
+
+  breaker, ok := breakers[key]
+  if !ok {
+    breaker = &circuitBreaker{state: breakerClosed}
+    breakers[key] = breaker
+  }
+  return breaker
+}
+
+func (b *circuitBreaker) allow() bool {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  switch b.state {
+  case breakerOpen:
+    if time.Since(b.openedAt) < breakerOpenDuration {
+      return false
+    }
+    b.state = breakerHalfOpen
+    b.probing = true
+    return true
+  case breakerHalfOpen:
+    if b.probing {
+      return false
+    }
+    b.probing = true
+    return true
+  }
+  return true
+}
+
+// available reports whether allow would let a request through, without
+// taking the half-open probe
+func (b *circuitBreaker) available() bool {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  switch b.state {
+  case breakerOpen:
+    return time.Since(b.openedAt) >= breakerOpenDuration
+  case breakerHalfOpen:
+    return !b.probing
+  }
+  return true
+}
+
+func (b *circuitBreaker) record(success bool) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  if len(b.window) < breakerWindowSize {
+    b.window = append(b.window, success)
+  } else {
+    b.window[b.next] = success
+    b.next = (b.next + 1) % breakerWindowSize
+  }
+
+  if success {
+    b.consecutiveFailures = 0
+    if b.state == breakerHalfOpen {
+      b.state = breakerClosed
+      b.probing = false
+      b.window = nil
+      b.next = 0
+    }
+    return
+  }
+
+  b.consecutiveFailures++
+  if b.state == breakerHalfOpen || b.consecutiveFailures >= breakerConsecutiveFailures || b.tripped() {
+    b.state = breakerOpen
+    b.openedAt = time.Now()
+    b.probing = false
+  }
+}
+
+// Must be called with the lock held
+func (b *circuitBreaker) errorRate() float64 {
+  if len(b.window) == 0 {
+    return 0
+  }
+  failures := 0
+  for _, success := range b.window {
+    if !success {
+      failures++
+    }
+  }
+  return float64(failures) / float64(len(b.window))
+}
+
+func (b *circuitBreaker) tripped() bool {
+  return len(b.window) >= breakerMinRequests && b.errorRate() >= breakerErrorRate
+}
+
+func (b *circuitBreaker) status() BreakerStatus {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  status := BreakerStatus{
+    State: b.state,
+    ConsecutiveFailures: b.consecutiveFailures,
+    ErrorRate: b.errorRate(),
+    Requests: len(b.window),
+  }
+  if b.state != breakerClosed {
+    status.OpenedAt = b.openedAt.Unix()
+    status.RetryAt = b.openedAt.Add(breakerOpenDuration).Unix()
+  }
+  return status
+}
+
+// release gives back a half-open probe that was never used
+func (b *circuitBreaker) release() {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+
+  if b.state == breakerHalfOpen {
+    b.probing = false
+  }
+}
+
+// breakerAllow takes a slot from both the provider and the model breaker, the
+// caller must report the outcome with breakerReport
+func breakerAllow(company string, model string) bool {
+  providerBreaker := getBreaker(providerBreakers, company)
+  if !providerBreaker.allow() {
+    return false
+  }
+  if !getBreaker(modelBreakers, company+"/"+model).allow() {
+    providerBreaker.release()
+    return false
+  }
+  return true
+}
+
+// breakerAvailable is the side effect free check used for routing
+func breakerAvailable(company string, model string) bool {
+  return getBreaker(providerBreakers, company).available() && getBreaker(modelBreakers, company+"/"+model).available()
+}
+
+func breakerRecord(company string, model string, success bool) {
+  getBreaker(providerBreakers, company).record(success)
+  getBreaker(modelBreakers, company+"/"+model).record(success)
+}
+
+// breakerReport records the outcome of an upstream call. A client going away
+// says nothing about the upstream, so its slot is only given back.
+func breakerReport(company string, model string, statusCode int, err error) {
+  if statusCode == statusClientClosed {
+    getBreaker(providerBreakers, company).release()
+    getBreaker(modelBreakers, company+"/"+model).release()
+    return
+  }
+  breakerRecord(company, model, !upstreamFailed(statusCode, err))
+}
+
+// Outages count as failures, client errors and rate limits don't
+func upstreamFailed(statusCode int, err error) bool {
+  return err != nil || statusCode >= 500
+}
+
+func StatusHandler(c *fiber.Ctx) error {
+  breakersMu.Lock()
+  providerKeys := sortedBreakerKeys(providerBreakers)
+  modelKeys := sortedBreakerKeys(modelBreakers)
+  breakersMu.Unlock()
+
+  providerStatuses := fiber.Map{}
+  for _, company := range providerKeys {
+    providerStatuses[company] = getBreaker(providerBreakers, company).status()
+  }
+  // Registered providers without traffic are healthy
+  for company := range providers {
+    if _, ok := providerStatuses[company]; !ok {
+      providerStatuses[company] = BreakerStatus{State: breakerClosed}
+    }
+  }
+
+  modelStatuses := fiber.Map{}
+  for _, model := range modelKeys {
+    modelStatuses[model] = getBreaker(modelBreakers, model).status()
+  }
+
+  return c.JSON(fiber.Map{
+    "providers": providerStatuses,
+    "models": modelStatuses,
+  })
+}
+
+func sortedBreakerKeys(breakers map[string]*circuitBreaker) []string {
+  keys := make([]string, 0, len(breakers))
+  for key := range breakers {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "log"
+  "strings"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/bson"
+)
+
+// Output length assumed by pre-flight estimates when the caller gives none
+const estimatedOutputTokens = 1024
+
+// Budget caps are in USD. Provider and model caps apply to the current month.
+type Budget struct {
+  Monthly float64 `json:"monthly,omitempty" bson:"monthly,omitempty"`
+  Lifetime float64 `json:"lifetime,omitempty" bson:"lifetime,omitempty"`
+  Providers map[string]float64 `json:"providers,omitempty" bson:"providers,omitempty"`
+  Models map[string]float64 `json:"models,omitempty" bson:"models,omitempty"`
+  // SoftLimit only warns through X-Budget-Warning instead of rejecting
+  SoftLimit bool `json:"soft_limit" bson:"soft_limit"`
+}
+
+func currentMonth() string {
+  return time.Now().UTC().Format("2006-01")
+}
+
+// Model names are stored with the same dot escaping as the usage counters
+func escapeModelKey(model string) string {
+  return strings.Replace(model, ".", "\u2024", -1)
+}
+
+// Roughly four characters per token, enough for estimates
+func estimateInputTokens(body RequestBody) int {
+  chars, images := 0, 0
+  if body.SystemPrompt != nil {
+    chars += len(*body.SystemPrompt)
+  }
+  if body.Prompt != nil {
+    chars += len(*body.Prompt)
+  }
+  for _, msg := range body.Messages {
+    chars += len(msg.Content.Text())
+    images += msg.Content.images()
+  }
+  return chars/4 + 1 + images*estimatedImageTokens
+}
+
+func estimateCost(body RequestBody, outputTokens int, inputPrice float64, outputPrice float64) float64 {
+  return float64(estimateInputTokens(body))*(inputPrice/1000000) + float64(outputTokens)*(outputPrice/1000000)
+}
+
+// checkBudget reports the first cap the estimated cost would break
+func checkBudget(user User, company string, model string, estimate float64) (string, bool) {
+  budget := user.Budget
+  if budget == nil {
+    return "", false
+  }
+
+  month := user.MonthlyUsage[currentMonth()]
+  lifetime := user.InputUsage + user.OutputUsage
+
+  if budget.Lifetime > 0 && lifetime+estimate > budget.Lifetime {
+    return fmt.Sprintf("lifetime budget of $%.2f reached ($%.4f spent)", budget.Lifetime, lifetime), true
+  }
+  if budget.Monthly > 0 && month.Total+estimate > budget.Monthly {
+    return fmt.Sprintf("monthly budget of $%.2f reached ($%.4f spent)", budget.Monthly, month.Total), true
+  }
+  if limit, ok := budget.Providers[company]; ok && month.Companies[company]+estimate > limit {
+    return fmt.Sprintf("monthly %s budget of $%.2f reached ($%.4f spent)", company, limit, month.Companies[company]), true
+  }
+  modelKey := escapeModelKey(model)
+  if limit, ok := budget.Models[modelKey]; ok && month.Models[modelKey]+estimate > limit {
+    return fmt.Sprintf("monthly %s budget of $%.2f reached ($%.4f spent)", model, limit, month.Models[modelKey]), true
+  }
+
+  return "", false
+}
+
+// enforceBudget writes a 402 response and returns true when the request must
+// stop, soft limits only get a warning header
+func enforceBudget(c *fiber.Ctx, user User, company string, model string, estimate float64) (bool, error) {
+  message, exceeded := checkBudget(user, company, model, estimate)
+  if !exceeded {
+    return false, nil
+  }
+
+  if user.Budget.SoftLimit {
+    c.Set("X-Budget-Warning", message)
+    return false, nil
+  }
+
+  return true, c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
+    "error": "Budget exceeded: " + message,
+  })
+}
+
+// addMonthlySpend adds the counters checked by the monthly caps to an $inc
+func addMonthlySpend(inc bson.M, month string, company string, model string, cost float64) {
+  monthKey := "monthly_usage." + month
+  inc[monthKey + ".total"] = cost
+  inc[monthKey + ".companies." + company] = cost
+  inc[monthKey + ".models." + escapeModelKey(model)] = cost
+}
+
+func GetBudgetHandler(c *fiber.Ctx) error {
+  user, err := findUser(c.Params("id"))
+  if err != nil {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "User not found",
+    })
+  }
+
+  return c.JSON(fiber.Map{
+    "id_user": user.ID,
+    "budget": user.Budget,
+    "lifetime_usage": user.InputUsage + user.OutputUsage,
+    "month": currentMonth(),
+    "monthly_usage": user.MonthlyUsage[currentMonth()],
+  })
+}
+
+// validate rejects negative caps and caps on providers or models that
+// don't exist, as they would block every call or never apply
+func (budget Budget) validate() error {
+  if budget.Monthly < 0 || budget.Lifetime < 0 {
+    return errors.New("Budgets can't be negative")
+  }
+  for company, limit := range budget.Providers {
+    if _, ok := getProvider(company); !ok {
+      return fmt.Errorf("Provider %s is not registered", company)
+    }
+    if limit < 0 {
+      return fmt.Errorf("The budget for %s can't be negative", company)
+    }
+  }
+  for model, limit := range budget.Models {
+    if _, err := findModelCompany(model); err != nil {
+      return fmt.Errorf("Model %s is not in the catalog", model)
+    }
+    if limit < 0 {
+      return fmt.Errorf("The budget for %s can't be negative", model)
+    }
+  }
+  return nil
+}
+
+func SetBudgetHandler(c *fiber.Ctx) error {
+  var budget Budget
+  if err := c.BodyParser(&budget); err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "Cannot parse JSON",
+    })
+  }
+
+  if err := budget.validate(); err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  models := make(map[string]float64)
+  for model, limit := range budget.Models {
+    models[escapeModelKey(model)] = limit
+  }
+  budget.Models = models
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  result, err := userCollection.UpdateOne(ctx, bson.M{"id_user": c.Params("id")}, bson.M{
+    "$set": bson.M{"budget": budget},
+  })
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+  if result.MatchedCount == 0 {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "User not found",
+    })
+  }
+
+  return c.JSON(budget)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+  "testing"
+)
+
+func TestBudgetValidate(t *testing.T) {
+  previous := modelCatalog.Load()
+  modelCatalog.Store(brainTestCatalog())
+  t.Cleanup(func() { modelCatalog.Store(previous) })
+
+  tests := []struct {
+    name string
+    budget Budget
+    valid bool
+  }{
+    {"empty", Budget{}, true},
+    {"caps", Budget{Monthly: 10, Providers: map[string]float64{"openai": 5}, Models: map[string]float64{"brain-test-small": 1}}, true},
+    {"zero cap", Budget{Providers: map[string]float64{"anthropic": 0}}, true},
+    {"negative monthly", Budget{Monthly: -1}, false},
+    {"negative lifetime", Budget{Lifetime: -1}, false},
+    {"negative provider cap", Budget{Providers: map[string]float64{"openai": -5}}, false},
+    {"negative model cap", Budget{Models: map[string]float64{"brain-test-small": -1}}, false},
+    {"unknown provider", Budget{Providers: map[string]float64{"openia": 5}}, false},
+    {"unknown model", Budget{Models: map[string]float64{"gpt-5-imaginary": 1}}, false},
+  }
+  for _, test := range tests {
+    err := test.budget.validate()
+    if (err == nil) != test.valid {
+      t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+    }
+  }
+}
@@ -0,0 +1,444 @@
+package handlers
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log"
+  "os"
+  "os/signal"
+  "sort"
+  "sync"
+  "sync/atomic"
+  "syscall"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+const modelCatalogPath = "services/models.json"
+
+// ModelCatalog is the validated set of models that can be called. models.json
+// seeds the models collection, which admins edit and the catalog is built from.
+type ModelCatalog struct {
+  Companies map[string]CompanyModels
+  // Version is the start of the catalog's sha256, it changes with every edit
+  Version string
+  Modified time.Time
+  Loaded time.Time
+}
+
+type CompanyModels struct {
+  Models map[string]ModelSpec `json:"models"`
+}
+
+type ModelSpec struct {
+  Description string `json:"description" bson:"description"`
+  // ContextWindow is the maximum number of input and output tokens
+  ContextWindow int `json:"context_window,omitempty" bson:"context_window,omitempty"`
+  // MaxOutputTokens caps max_tokens and is Anthropic's default max_tokens
+  MaxOutputTokens int `json:"max_output_tokens,omitempty" bson:"max_output_tokens,omitempty"`
+  Capabilities []string `json:"capabilities" bson:"capabilities"`
+  PricePerTokens *TokenPrices `json:"price_per_1million_tokens,omitempty" bson:"price_per_1million_tokens,omitempty"`
+  // Audio models are billed per minute instead of per token
+  PricePerMinute float64 `json:"price_per_minute,omitempty" bson:"price_per_minute,omitempty"`
+  // EffectiveFrom is when the price above started, unset means always
+  EffectiveFrom *time.Time `json:"effective_from,omitempty" bson:"effective_from,omitempty"`
+  PriceHistory []PricePeriod `json:"price_history,omitempty" bson:"price_history,omitempty"`
+  BenchmarkScores BenchmarkScores `json:"benchmarks-scores,omitempty" bson:"benchmarks_scores,omitempty"`
+}
+
+// TokenPrices are in USD per million tokens. Cached input and cache writes
+// cost the input price unless a tier is set.
+type TokenPrices struct {
+  Input float64 `json:"input" bson:"input"`
+  Output float64 `json:"output" bson:"output"`
+  CachedInput *float64 `json:"cached_input,omitempty" bson:"cached_input,omitempty"`
+  CacheWrite *float64 `json:"cache_write,omitempty" bson:"cache_write,omitempty"`
+}
+
+func (prices TokenPrices) negative() bool {
+  for _, tier := range []*float64{prices.CachedInput, prices.CacheWrite} {
+    if tier != nil && *tier < 0 {
+      return true
+    }
+  }
+  return prices.Input < 0 || prices.Output < 0
+}
+
+// Capabilities a model can be listed with
+var knownCapabilities = map[string]bool{
+  "chat": true,
+  "embeddings": true,
+  "json": true,
+  "stream": true,
+  "transcription": true,
+  "vision": true,
+}
+
+// BenchmarkScores only keeps the published scores, "NA" entries are dropped
+type BenchmarkScores map[string]float64
+
+func (scores *BenchmarkScores) UnmarshalJSON(data []byte) error {
+  var raw map[string]json.RawMessage
+  if err := json.Unmarshal(data, &raw); err != nil {
+    return err
+  }
+
+  *scores = BenchmarkScores{}
+  for benchmark, value := range raw {
+    var score float64
+    if err := json.Unmarshal(value, &score); err == nil {
+      (*scores)[benchmark] = score
+      continue
+    }
+    var text string
+    if err := json.Unmarshal(value, &text); err == nil && text == "NA" {
+      continue
+    }
+    return fmt.Errorf("benchmark %s must be a number or \"NA\", got %s", benchmark, value)
+  }
+  return nil
+}
+
+var (
+  modelCatalog atomic.Pointer[ModelCatalog]
+  // catalogReloadMu serialises reloads from the watcher and SIGHUP
+  catalogReloadMu sync.Mutex
+  catalogReloadError atomic.Value
+)
+
+// currentCatalog returns the last catalog that passed validation
+func currentCatalog() *ModelCatalog {
+  if catalog := modelCatalog.Load(); catalog != nil {
+    return catalog
+  }
+  return &ModelCatalog{Companies: map[string]CompanyModels{}}
+}
+
+// LoadModelCatalog parses and validates models.json, applies it to the models
+// that follow the file and makes the stored models the current catalog. An invalid file is rejected
+// and the previous catalog stays in use.
+func LoadModelCatalog() error {
+  catalogReloadMu.Lock()
+  defer catalogReloadMu.Unlock()
+
+  catalog, err := readModelCatalog(modelCatalogPath)
+  if err == nil && modelsCollection != nil {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    if err = seedModels(ctx, catalog); err == nil {
+      catalog, err = loadStoredCatalog(ctx, catalog.Modified)
+    }
+  }
+  if err != nil {
+    catalogReloadError.Store(err.Error())
+    return err
+  }
+
+  previous := modelCatalog.Swap(catalog)
+  catalogReloadError.Store("")
+  if previous == nil || previous.Version != catalog.Version {
+    log.Printf("Loaded model catalog version %s", catalog.Version)
+  }
+  return nil
+}
+
+// WatchModelCatalog reloads the catalog when models.json changes on disk or
+// the server receives SIGHUP, and otherwise picks up admin edits made
+// through other instances
+func WatchModelCatalog(interval time.Duration) {
+  hangups := make(chan os.Signal, 1)
+  signal.Notify(hangups, syscall.SIGHUP)
+
+  ticker := time.NewTicker(interval)
+  defer ticker.Stop()
+
+  // A rejected edit is only reported once, not on every tick
+  seen := currentCatalog().Modified
+  for {
+    select {
+    case <-hangups:
+    case <-ticker.C:
+      info, err := os.Stat(modelCatalogPath)
+      if err != nil || info.ModTime().Equal(seen) {
+        if modelsCollection != nil {
+          if err := refreshModelCatalog(); err != nil {
+            log.Printf("Error refreshing model catalog: %v", err)
+          }
+        }
+        continue
+      }
+      seen = info.ModTime()
+    }
+
+    if err := LoadModelCatalog(); err != nil {
+      log.Printf("Rejected model catalog, keeping version %s: %v", currentCatalog().Version, err)
+    }
+  }
+}
+
+func readModelCatalog(path string) (*ModelCatalog, error) {
+  info, err := os.Stat(path)
+  if err != nil {
+    return nil, err
+  }
+  modelsFile, err := os.ReadFile(path)
+  if err != nil {
+    return nil, err
+  }
+
+  // Unknown fields are rejected so that typos don't go unnoticed
+  var companies map[string]CompanyModels
+  decoder := json.NewDecoder(bytes.NewReader(modelsFile))
+  decoder.DisallowUnknownFields()
+  if err := decoder.Decode(&companies); err != nil {
+    return nil, fmt.Errorf("parsing %s: %w", path, err)
+  }
+  if err := validateCatalog(companies); err != nil {
+    return nil, err
+  }
+
+  digest := sha256.Sum256(modelsFile)
+  return &ModelCatalog{
+    Companies: companies,
+    Version: hex.EncodeToString(digest[:])[:12],
+    Modified: info.ModTime(),
+    Loaded: time.Now(),
+  }, nil
+}
+
+// validateCatalog checks what the JSON decoder can't: every model needs a
+// description, known capabilities and exactly one kind of non-negative price,
+// and a model name may only be served by one company
+func validateCatalog(companies map[string]CompanyModels) error {
+  if len(companies) == 0 {
+    return fmt.Errorf("models.json has no companies")
+  }
+
+  owners := map[string]string{}
+  for _, company := range sortedKeys(companies) {
+    models := companies[company].Models
+    if len(models) == 0 {
+      return fmt.Errorf("%s has no models", company)
+    }
+
+    for _, model := range sortedKeys(models) {
+      spec := models[model]
+      if spec.Description == "" {
+        return fmt.Errorf("%s/%s has no description", company, model)
+      }
+      if owner, ok := owners[model]; ok {
+        return fmt.Errorf("%s is listed by both %s and %s", model, owner, company)
+      }
+      owners[model] = company
+
+      if len(spec.Capabilities) == 0 {
+        return fmt.Errorf("%s/%s has no capabilities", company, model)
+      }
+      for _, capability := range spec.Capabilities {
+        if !knownCapabilities[capability] {
+          return fmt.Errorf("%s/%s has unknown capability %q", company, model, capability)
+        }
+      }
+      if spec.ContextWindow < 0 {
+        return fmt.Errorf("%s/%s has a negative context window", company, model)
+      }
+      if spec.MaxOutputTokens < 0 {
+        return fmt.Errorf("%s/%s has a negative max_output_tokens", company, model)
+      }
+
+      switch {
+      case spec.PricePerTokens != nil && spec.PricePerMinute != 0:
+        return fmt.Errorf("%s/%s has both token and per minute prices", company, model)
+      case spec.PricePerTokens != nil:
+        if spec.PricePerTokens.negative() {
+          return fmt.Errorf("%s/%s has a negative token price", company, model)
+        }
+      case spec.PricePerMinute < 0:
+        return fmt.Errorf("%s/%s has a negative per minute price", company, model)
+      case spec.PricePerMinute == 0:
+        return fmt.Errorf("%s/%s has no price", company, model)
+      }
+      if err := validatePrices(company, model, spec); err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+// Model returns the spec of a company's model
+func (catalog *ModelCatalog) Model(company string, model string) (ModelSpec, bool) {
+  spec, ok := catalog.Companies[company].Models[model]
+  return spec, ok
+}
+
+// FindCompany returns the company serving a model
+func (catalog *ModelCatalog) FindCompany(model string) (string, bool) {
+  for company, companyModels := range catalog.Companies {
+    if _, ok := companyModels.Models[model]; ok {
+      return company, true
+    }
+  }
+  return "", false
+}
+
+// HasCapability reports whether the model lists the capability
+func (spec ModelSpec) HasCapability(capability string) bool {
+  for _, listed := range spec.Capabilities {
+    if listed == capability {
+      return true
+    }
+  }
+  return false
+}
+
+// lastCatalogError is the reason the latest reload was rejected, if it was
+func lastCatalogError() string {
+  message, _ := catalogReloadError.Load().(string)
+  return message
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+  keys := make([]string, 0, len(values))
+  for key := range values {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// ModelListing is a catalog entry as returned by the /models routes
+type ModelListing struct {
+  Company string `json:"company"`
+  Model string `json:"model"`
+  ModelSpec
+  // AverageScore is the mean of the published benchmark scores
+  AverageScore float64 `json:"average_score,omitempty"`
+}
+
+func newModelListing(company string, model string, spec ModelSpec) ModelListing {
+  return ModelListing{Company: company, Model: model, ModelSpec: spec, AverageScore: averageScore(spec)}
+}
+
+// ModelsHandler lists the catalog, e.g.
+// /models?company=google&capability=json&sort=price or
+// /models?sort=benchmark&benchmark=MMLU&order=desc
+func ModelsHandler(c *fiber.Ctx) error {
+  company := c.Query("company")
+  capability := c.Query("capability")
+  sortBy := c.Query("sort")
+  benchmark := c.Query("benchmark")
+  order := c.Query("order")
+
+  if capability != "" && !knownCapabilities[capability] {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": fmt.Sprintf("Unknown capability %s", capability),
+    })
+  }
+  switch sortBy {
+  case "", "name", "price", "benchmark":
+  default:
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "sort must be one of name, price or benchmark",
+    })
+  }
+  switch order {
+  case "", "asc", "desc":
+  default:
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "order must be asc or desc",
+    })
+  }
+
+  catalog := currentCatalog()
+  listings := []ModelListing{}
+  for companyName, companyModels := range catalog.Companies {
+    if company != "" && companyName != company {
+      continue
+    }
+    for model, spec := range companyModels.Models {
+      if capability != "" && !spec.HasCapability(capability) {
+        continue
+      }
+      listings = append(listings, newModelListing(companyName, model, spec))
+    }
+  }
+
+  // Cheapest and best scoring first unless the order says otherwise, models
+  // without the price or score go last either way
+  descending := order == "desc" || order == "" && sortBy == "benchmark"
+  sort.SliceStable(listings, func(i, j int) bool {
+    left, right := listings[i], listings[j]
+    leftName, rightName := left.Company+"/"+left.Model, right.Company+"/"+right.Model
+
+    var leftValue, rightValue float64
+    var leftOK, rightOK bool
+    switch sortBy {
+    case "price":
+      leftValue, leftOK = listingPrice(left)
+      rightValue, rightOK = listingPrice(right)
+    case "benchmark":
+      leftValue, leftOK = listingScore(left, benchmark)
+      rightValue, rightOK = listingScore(right, benchmark)
+    default:
+      if descending {
+        return leftName > rightName
+      }
+      return leftName < rightName
+    }
+
+    if leftOK != rightOK {
+      return leftOK
+    }
+    if leftValue != rightValue {
+      if descending {
+        return leftValue > rightValue
+      }
+      return leftValue < rightValue
+    }
+    return leftName < rightName
+  })
+
+  return c.JSON(fiber.Map{
+    "version": catalog.Version,
+    "models": listings,
+  })
+}
+
+// ModelHandler returns a single catalog entry
+func ModelHandler(c *fiber.Ctx) error {
+  company := c.Params("company")
+  model := c.Params("model")
+
+  spec, ok := currentCatalog().Model(company, model)
+  if !ok {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s is not available for %s", model, company),
+    })
+  }
+
+  return c.JSON(newModelListing(company, model, spec))
+}
+
+// Token models are compared by the sum of their input and output prices
+func listingPrice(listing ModelListing) (float64, bool) {
+  if listing.PricePerTokens == nil {
+    return 0, false
+  }
+  return listing.PricePerTokens.Input + listing.PricePerTokens.Output, true
+}
+
+// A named benchmark, or the average when no benchmark is given
+func listingScore(listing ModelListing, benchmark string) (float64, bool) {
+  if benchmark == "" {
+    return listing.AverageScore, len(listing.BenchmarkScores) > 0
+  }
+  score, ok := listing.BenchmarkScores[benchmark]
+  return score, ok
+}
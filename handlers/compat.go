@@ -0,0 +1,248 @@
+package handlers
+
+import (
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// OpenAITranslator is implemented by providers whose native responses have to
+// be converted for the OpenAI compatible facade
+type OpenAITranslator interface {
+  // TranslateResponse converts a complete response into a chat completion
+  TranslateResponse(response []byte) (ChatCompletion, error)
+  // TranslateEvent returns the delta and finish reason of one stream event,
+  // tool call deltas carry the provider's index of the call
+  TranslateEvent(data []byte) (ChatDelta, string)
+}
+
+// ChatCompletionRequest is the subset of OpenAI's request schema we support
+type ChatCompletionRequest struct {
+  ID string `json:"id_user,omitempty"`
+  Model string `json:"model"`
+  Messages []Message `json:"messages"`
+  Temperature *float64 `json:"temperature,omitempty"`
+  TopP *float64 `json:"top_p,omitempty"`
+  MaxTokens *int `json:"max_tokens,omitempty"`
+  Stop StopSequences `json:"stop,omitempty"`
+  Seed *int64 `json:"seed,omitempty"`
+  PresencePenalty *float64 `json:"presence_penalty,omitempty"`
+  FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+  ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+  Tools []Tool `json:"tools,omitempty"`
+  ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+  Stream bool `json:"stream,omitempty"`
+  Fallback *[]string `json:"fallback,omitempty"`
+}
+
+type ChatCompletion struct {
+  ID string `json:"id"`
+  Object string `json:"object"`
+  Created int64 `json:"created"`
+  Model string `json:"model"`
+  Choices []ChatChoice `json:"choices"`
+  Usage *ChatUsage `json:"usage,omitempty"`
+}
+
+type ChatChoice struct {
+  Index int `json:"index"`
+  Message *OAIMessage `json:"message,omitempty"`
+  Delta *ChatDelta `json:"delta,omitempty"`
+  FinishReason *string `json:"finish_reason"`
+}
+
+type ChatDelta struct {
+  Role string `json:"role,omitempty"`
+  Content string `json:"content,omitempty"`
+  ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+type ChatUsage struct {
+  PromptTokens int `json:"prompt_tokens"`
+  CompletionTokens int `json:"completion_tokens"`
+  TotalTokens int `json:"total_tokens"`
+}
+
+func newChatCompletion(text string, toolCalls []ToolCall, finishReason string, usage ChatUsage) ChatCompletion {
+  usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+  if len(toolCalls) > 0 {
+    finishReason = "tool_calls"
+  }
+  return ChatCompletion{
+    Object: "chat.completion",
+    Choices: []ChatChoice{{
+      Message: &OAIMessage{Role: "assistant", Content: TextContent(text), ToolCalls: toolCalls},
+      FinishReason: optionalString(finishReason),
+    }},
+    Usage: &usage,
+  }
+}
+
+// Claude answers schemas with a forced tool call, OpenAI clients expect the
+// JSON as the message content
+func schemaContent(completion *ChatCompletion) {
+  for i := range completion.Choices {
+    choice := &completion.Choices[i]
+    if choice.Message == nil || len(choice.Message.ToolCalls) == 0 {
+      continue
+    }
+    choice.Message.Content = TextContent(choice.Message.ToolCalls[0].Function.Arguments)
+    choice.Message.ToolCalls = nil
+    stop := "stop"
+    choice.FinishReason = &stop
+  }
+}
+
+func schemaDelta(delta ChatDelta, finishReason string) (ChatDelta, string) {
+  for _, call := range delta.ToolCalls {
+    delta.Content += call.Function.Arguments
+  }
+  delta.ToolCalls = nil
+  if finishReason == "tool_calls" {
+    finishReason = "stop"
+  }
+  return delta, finishReason
+}
+
+func optionalString(value string) *string {
+  if value == "" {
+    return nil
+  }
+  return &value
+}
+
+func newCompletionID() string {
+  id := make([]byte, 12)
+  rand.Read(id)
+  return "chatcmpl-" + hex.EncodeToString(id)
+}
+
+// ChatCompletionsHandler serves OpenAI's chat completions API for every model
+// in models.json, so OpenAI client libraries can use this service as base URL
+func ChatCompletionsHandler(c *fiber.Ctx) error {
+  // Read request body
+  var request ChatCompletionRequest
+  if err := c.BodyParser(&request); err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "Cannot parse JSON",
+    })
+  }
+
+  company, err := findModelCompany(request.Model)
+  if err != nil {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "The model " + request.Model + " does not exist",
+    })
+  }
+
+  // Only ask for JSON when the caller did, unlike the native routes
+  outputJSON := request.ResponseFormat != nil && request.ResponseFormat.Type == "json_object"
+  var outputSchema *OutputSchema
+  if format := request.ResponseFormat; format != nil && format.Type == "json_schema" {
+    if format.JSONSchema == nil {
+      return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+        "error": "response_format json_schema needs a json_schema",
+      })
+    }
+    outputJSON = true
+    outputSchema = &OutputSchema{Name: format.JSONSchema.Name, Schema: format.JSONSchema.Schema}
+  }
+  requestBody := RequestBody{
+    ID: request.ID,
+    Model: request.Model,
+    Messages: request.Messages,
+    OutputJSON: &outputJSON,
+    OutputSchema: outputSchema,
+    Stream: &request.Stream,
+    Generation: &Generation{
+      Temperature: request.Temperature,
+      TopP: request.TopP,
+      MaxTokens: request.MaxTokens,
+      Stop: request.Stop,
+      Seed: request.Seed,
+      PresencePenalty: request.PresencePenalty,
+      FrequencyPenalty: request.FrequencyPenalty,
+    },
+    Tools: request.Tools,
+    ToolChoice: request.ToolChoice,
+    Fallback: request.Fallback,
+  }
+
+  // Fallbacks may be served by another provider, so translation is decided
+  // per response. OpenAI responses are already in the right shape.
+  id := newCompletionID()
+  created := time.Now().Unix()
+
+  // Streamed tool calls are numbered from 0 in the order they start,
+  // providers number them by content block or not at all
+  toolIndexes := map[int]int{}
+  toolCalls := 0
+  format := &outputFormat{
+    Response: func(provider Provider, response []byte) ([]byte, error) {
+      translator, ok := provider.(OpenAITranslator)
+      if !ok {
+        return response, nil
+      }
+      completion, err := translator.TranslateResponse(response)
+      if err != nil {
+        return nil, err
+      }
+      if outputSchema != nil {
+        schemaContent(&completion)
+      }
+      completion.ID = id
+      completion.Created = created
+      completion.Model = request.Model
+      return json.Marshal(completion)
+    },
+    Event: func(provider Provider, data []byte) []byte {
+      translator, ok := provider.(OpenAITranslator)
+      if !ok {
+        return data
+      }
+      delta, finishReason := translator.TranslateEvent(data)
+      if outputSchema != nil {
+        delta, finishReason = schemaDelta(delta, finishReason)
+      }
+      if delta.Content == "" && len(delta.ToolCalls) == 0 && finishReason == "" {
+        return nil
+      }
+
+      for i, call := range delta.ToolCalls {
+        index := toolCalls
+        if call.ID != "" {
+          toolCalls++
+          if call.Index != nil {
+            toolIndexes[*call.Index] = index
+          }
+        } else if call.Index != nil {
+          index = toolIndexes[*call.Index]
+        }
+        delta.ToolCalls[i].Index = &index
+      }
+      if toolCalls > 0 && finishReason == "stop" {
+        finishReason = "tool_calls"
+      }
+
+      delta.Role = "assistant"
+      chunk, _ := json.Marshal(ChatCompletion{
+        ID: id,
+        Object: "chat.completion.chunk",
+        Created: created,
+        Model: request.Model,
+        Choices: []ChatChoice{{
+          Delta: &delta,
+          FinishReason: optionalString(finishReason),
+        }},
+      })
+      return chunk
+    },
+    Done: "[DONE]",
+  }
+
+  c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+  return handleCompletion(c, company, requestBody, format)
+}
@@ -0,0 +1,405 @@
+package handlers
+
+import (
+  "context"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io"
+  "io/ioutil"
+  "mime"
+  "net"
+  "net/http"
+  "strings"
+  "syscall"
+  "time"
+)
+
+// Gemini takes at most 20MB of inline data per request, which also caps the
+// images fetched for one request
+const maxImageBytes = 20 << 20
+
+// Providers don't report image tokens before the call, this is about the
+// largest image Claude accepts and more than OpenAI or Gemini charge
+const estimatedImageTokens = 1600
+
+// Media types every provider accepts
+var imageTypes = map[string]bool{
+  "image/jpeg": true,
+  "image/png": true,
+  "image/gif": true,
+  "image/webp": true,
+}
+
+// MessageContent is the content of a message, sent as a string or as an
+// array of OpenAI style text and image_url parts
+type MessageContent []ContentPart
+
+type ContentPart struct {
+  // Type is text or image_url
+  Type string `json:"type"`
+  Text string `json:"text,omitempty"`
+  ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL is an http(s) URL or a base64 data URL
+type ImageURL struct {
+  URL string `json:"url"`
+  // Detail is only used by OpenAI: auto, low or high
+  Detail string `json:"detail,omitempty"`
+}
+
+func TextContent(text string) MessageContent {
+  return MessageContent{{Type: "text", Text: text}}
+}
+
+func (content *MessageContent) UnmarshalJSON(data []byte) error {
+  var text *string
+  if err := json.Unmarshal(data, &text); err == nil {
+    *content = nil
+    if text != nil {
+      *content = TextContent(*text)
+    }
+    return nil
+  }
+
+  var parts []ContentPart
+  if err := json.Unmarshal(data, &parts); err != nil {
+    return errors.New("content must be a string or an array of parts")
+  }
+  *content = parts
+  return nil
+}
+
+// Text only content is sent as a string, as every OpenAI model accepts it
+func (content MessageContent) MarshalJSON() ([]byte, error) {
+  if !content.HasImages() {
+    return json.Marshal(content.Text())
+  }
+  return json.Marshal([]ContentPart(content))
+}
+
+// Text joins the text parts
+func (content MessageContent) Text() string {
+  var texts []string
+  for _, part := range content {
+    if part.Type == "text" {
+      texts = append(texts, part.Text)
+    }
+  }
+  return strings.Join(texts, "\n")
+}
+
+func (content MessageContent) HasImages() bool {
+  return content.images() > 0
+}
+
+func (content MessageContent) images() int {
+  images := 0
+  for _, part := range content {
+    if part.Type == "image_url" {
+      images++
+    }
+  }
+  return images
+}
+
+func requestHasImages(body RequestBody) bool {
+  for _, msg := range body.Messages {
+    if msg.Content.HasImages() {
+      return true
+    }
+  }
+  return false
+}
+
+func readsImages(company string, model string) bool {
+  spec, ok := currentCatalog().Model(company, model)
+  return ok && spec.HasCapability("vision")
+}
+
+// validateContent checks the parts of every message, images may only be sent
+// by the user. Providers reject empty messages, so every message but tool
+// results needs text, an image or a tool call.
+func validateContent(body RequestBody) error {
+  if len(body.Messages) == 0 && body.Prompt != nil && blank(*body.Prompt) {
+    return errors.New("prompt can't be empty")
+  }
+  for i, msg := range body.Messages {
+    for _, part := range msg.Content {
+      switch part.Type {
+      case "text":
+      case "image_url":
+        if msg.Role != "user" {
+          return errors.New("images can only be sent in user messages")
+        }
+        if part.ImageURL == nil {
+          return errors.New("image_url parts need an image_url")
+        }
+        if _, err := parseImageURL(part.ImageURL.URL); err != nil {
+          return err
+        }
+      default:
+        return fmt.Errorf("unsupported content part type %q", part.Type)
+      }
+    }
+    if msg.Role != "tool" && len(msg.ToolCalls) == 0 && !msg.Content.HasImages() && blank(msg.Content.Text()) {
+      return fmt.Errorf("message %d is empty, messages need text, images or tool calls", i)
+    }
+  }
+  return nil
+}
+
+func blank(text string) bool {
+  return strings.TrimSpace(text) == ""
+}
+
+// imageSource is an image either by URL or decoded from a data URL
+type imageSource struct {
+  URL string
+  MediaType string
+  // Data is base64 encoded
+  Data string
+}
+
+func parseImageURL(url string) (imageSource, error) {
+  if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+    return imageSource{URL: url}, nil
+  }
+  if !strings.HasPrefix(url, "data:") {
+    return imageSource{}, errors.New("image_url must be an http(s) URL or a base64 data URL")
+  }
+
+  header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+  mediaType, ok64 := strings.CutSuffix(header, ";base64")
+  if !ok || !ok64 {
+    return imageSource{}, errors.New("image data URLs must be base64 encoded")
+  }
+  if !imageTypes[mediaType] {
+    return imageSource{}, fmt.Errorf("unsupported image type %q, use jpeg, png, gif or webp", mediaType)
+  }
+  if base64.StdEncoding.DecodedLen(len(data)) > maxImageBytes {
+    return imageSource{}, errors.New("images are limited to 20MB")
+  }
+  if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+    return imageSource{}, errors.New("image data URL is not valid base64")
+  }
+  return imageSource{MediaType: mediaType, Data: data}, nil
+}
+
+// Fetching every image of a request may take this long
+const imageFetchTimeout = 30 * time.Second
+
+// imageClient only connects to public addresses. The dialer checks every
+// address it connects to, so redirects and DNS answers pointing inside the
+// network are refused too. Proxies are not used as they would hide the target.
+var imageClient = &http.Client{
+  Transport: &http.Transport{
+    DialContext: (&net.Dialer{Timeout: 10 * time.Second, Control: checkImageAddress}).DialContext,
+    TLSHandshakeTimeout: 10 * time.Second,
+    IdleConnTimeout: 90 * time.Second,
+  },
+  CheckRedirect: func(req *http.Request, via []*http.Request) error {
+    if len(via) >= 5 {
+      return errors.New("too many redirects")
+    }
+    if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+      return errors.New("redirect to an unsupported scheme")
+    }
+    return nil
+  },
+}
+
+var errPrivateImageAddress = errors.New("image URLs must point to a public address")
+
+// allowImageAddress reports whether images may be fetched from an address
+var allowImageAddress = publicAddress
+
+// Special purpose ranges that net.IP doesn't classify
+var reservedNetworks = []*net.IPNet{
+  mustParseCIDR("0.0.0.0/8"),
+  mustParseCIDR("100.64.0.0/10"),
+  mustParseCIDR("192.0.0.0/24"),
+  mustParseCIDR("198.18.0.0/15"),
+  mustParseCIDR("240.0.0.0/4"),
+  mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+  _, network, err := net.ParseCIDR(cidr)
+  if err != nil {
+    panic(err)
+  }
+  return network
+}
+
+func publicAddress(ip net.IP) bool {
+  if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+    return false
+  }
+  for _, network := range reservedNetworks {
+    if network.Contains(ip) {
+      return false
+    }
+  }
+  return true
+}
+
+func checkImageAddress(network string, address string, _ syscall.RawConn) error {
+  host, _, err := net.SplitHostPort(address)
+  if err != nil {
+    return err
+  }
+  if ip := net.ParseIP(host); ip == nil || !allowImageAddress(ip) {
+    return errPrivateImageAddress
+  }
+  return nil
+}
+
+// fetchImage downloads an image URL of at most limit bytes
+func fetchImage(ctx context.Context, url string, limit int64) (imageSource, int64, error) {
+  req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+  if err != nil {
+    return imageSource{}, 0, fmt.Errorf("error fetching image %s", url)
+  }
+  resp, err := imageClient.Do(req)
+  if err != nil {
+    if errors.Is(err, errPrivateImageAddress) {
+      return imageSource{}, 0, fmt.Errorf("error fetching image %s: %v", url, errPrivateImageAddress)
+    }
+    return imageSource{}, 0, fmt.Errorf("error fetching image %s", url)
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return imageSource{}, 0, fmt.Errorf("error fetching image %s: status %d", url, resp.StatusCode)
+  }
+
+  mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+  if !imageTypes[mediaType] {
+    return imageSource{}, 0, fmt.Errorf("image %s has unsupported type %q", url, mediaType)
+  }
+
+  data, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+  if err != nil {
+    return imageSource{}, 0, fmt.Errorf("error fetching image %s", url)
+  }
+  if int64(len(data)) > limit {
+    return imageSource{}, 0, errors.New("images are limited to 20MB per request")
+  }
+  return imageSource{MediaType: mediaType, Data: base64.StdEncoding.EncodeToString(data)}, int64(len(data)), nil
+}
+
+// InlineImageProvider is implemented by providers that only read images sent
+// as data, image URLs are fetched for them by inlineImageURLs
+type InlineImageProvider interface {
+  InlineImages() bool
+}
+
+// inlineImageURLs replaces image URLs with data URLs. The images are fetched
+// once per request with the request's context, and together with the images
+// already sent as data they may add up to 20MB.
+func inlineImageURLs(ctx context.Context, body RequestBody) (RequestBody, error) {
+  ctx, cancel := context.WithTimeout(ctx, imageFetchTimeout)
+  defer cancel()
+
+  remaining := int64(maxImageBytes)
+  for _, msg := range body.Messages {
+    for _, part := range msg.Content {
+      if part.Type == "image_url" && part.ImageURL != nil {
+        if image, err := parseImageURL(part.ImageURL.URL); err == nil && image.URL == "" {
+          remaining -= int64(base64.StdEncoding.DecodedLen(len(image.Data)))
+        }
+      }
+    }
+  }
+  if remaining < 0 {
+    return body, errors.New("images are limited to 20MB per request")
+  }
+
+  messages := make([]Message, len(body.Messages))
+  for i, msg := range body.Messages {
+    messages[i] = msg
+    if !msg.Content.HasImages() {
+      continue
+    }
+
+    content := append(MessageContent(nil), msg.Content...)
+    for j, part := range content {
+      // Invalid parts are reported when the request is built
+      if part.Type != "image_url" || part.ImageURL == nil {
+        continue
+      }
+      image, err := parseImageURL(part.ImageURL.URL)
+      if err != nil || image.URL == "" {
+        continue
+      }
+
+      fetched, size, err := fetchImage(ctx, image.URL, remaining)
+      if err != nil {
+        return body, err
+      }
+      remaining -= size
+      content[j].ImageURL = &ImageURL{URL: "data:" + fetched.MediaType + ";base64," + fetched.Data, Detail: part.ImageURL.Detail}
+    }
+    messages[i].Content = content
+  }
+  body.Messages = messages
+  return body, nil
+}
+
+// errImageURLs is returned by providers that need images inlined first
+var errImageURLs = errors.New("image URLs must be fetched first")
+
+// hasImageURLs reports whether any image still has to be fetched
+func hasImageURLs(body RequestBody) bool {
+  for _, msg := range body.Messages {
+    for _, part := range msg.Content {
+      if part.Type == "image_url" && part.ImageURL != nil && !strings.HasPrefix(part.ImageURL.URL, "data:") {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// geminiContentParts converts text and image parts, images must have been
+// inlined by inlineImageURLs as Gemini only reads inline data. Blank text
+// would be sent as an empty part, so it is dropped.
+func geminiContentParts(content MessageContent) []Part {
+  var parts []Part
+  for _, part := range content {
+    switch part.Type {
+    case "text":
+      if !blank(part.Text) {
+        parts = append(parts, Part{Text: part.Text})
+      }
+    case "image_url":
+      image, _ := parseImageURL(part.ImageURL.URL)
+      parts = append(parts, Part{InlineData: &InlineData{MIMEType: image.MediaType, Data: image.Data}})
+    }
+  }
+  return parts
+}
+
+// anthropicContentBlocks converts text and image parts, blank text blocks are
+// rejected by Anthropic so they are dropped
+func anthropicContentBlocks(content MessageContent) []ANTBlock {
+  var blocks []ANTBlock
+  for _, part := range content {
+    switch part.Type {
+    case "text":
+      if !blank(part.Text) {
+        blocks = append(blocks, ANTBlock{Type: "text", Text: part.Text})
+      }
+    case "image_url":
+      image, _ := parseImageURL(part.ImageURL.URL)
+      source := &ANTImageSource{Type: "base64", MediaType: image.MediaType, Data: image.Data}
+      if image.URL != "" {
+        source = &ANTImageSource{Type: "url", URL: image.URL}
+      }
+      blocks = append(blocks, ANTBlock{Type: "image", Source: source})
+    }
+  }
+  return blocks
+}
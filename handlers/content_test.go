@@ -0,0 +1,195 @@
+package handlers
+
+import (
+  "context"
+  "net"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync/atomic"
+  "testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+  tests := []struct {
+    ip string
+    public bool
+  }{
+    {"8.8.8.8", true},
+    {"2606:4700:4700::1111", true},
+    {"127.0.0.1", false},
+    {"::1", false},
+    {"10.1.2.3", false},
+    {"172.16.0.1", false},
+    {"192.168.1.1", false},
+    {"169.254.169.254", false},
+    {"fe80::1", false},
+    {"fd00::1", false},
+    {"0.0.0.0", false},
+    {"100.64.0.1", false},
+    {"::ffff:127.0.0.1", false},
+    {"::ffff:10.0.0.1", false},
+    {"224.0.0.1", false},
+  }
+  for _, test := range tests {
+    if got := publicAddress(net.ParseIP(test.ip)); got != test.public {
+      t.Errorf("publicAddress(%s) = %v, want %v", test.ip, got, test.public)
+    }
+  }
+}
+
+// allowLoopback lets the tests fetch from httptest servers
+func allowLoopback(t *testing.T) {
+  allowImageAddress = func(ip net.IP) bool {
+    return ip.IsLoopback() || publicAddress(ip)
+  }
+  t.Cleanup(func() { allowImageAddress = publicAddress })
+}
+
+func imageServer(t *testing.T, hits *int32, size int) *httptest.Server {
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    atomic.AddInt32(hits, 1)
+    w.Header().Set("Content-Type", "image/png")
+    w.Write(make([]byte, size))
+  }))
+  t.Cleanup(server.Close)
+  return server
+}
+
+func TestFetchImageRefusesPrivateAddresses(t *testing.T) {
+  var hits int32
+  server := imageServer(t, &hits, 10)
+
+  _, _, err := fetchImage(context.Background(), server.URL+"/cat.png", maxImageBytes)
+  if err == nil || !strings.Contains(err.Error(), "public address") {
+    t.Errorf("got error %v, want the address refused", err)
+  }
+  if hits != 0 {
+    t.Errorf("the server was reached %d times", hits)
+  }
+}
+
+func TestFetchImageRefusesRedirectsToPrivateAddresses(t *testing.T) {
+  allowLoopback(t)
+  redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+  }))
+  defer redirect.Close()
+
+  _, _, err := fetchImage(context.Background(), redirect.URL, maxImageBytes)
+  if err == nil || !strings.Contains(err.Error(), "public address") {
+    t.Errorf("got error %v, want the redirect refused", err)
+  }
+}
+
+func TestFetchImageLimit(t *testing.T) {
+  allowLoopback(t)
+  var hits int32
+  server := imageServer(t, &hits, 1000)
+
+  if _, size, err := fetchImage(context.Background(), server.URL, 1000); err != nil || size != 1000 {
+    t.Errorf("got size %d, error %v", size, err)
+  }
+  if _, _, err := fetchImage(context.Background(), server.URL, 999); err == nil {
+    t.Error("an image over the limit was accepted")
+  }
+}
+
+func imageMessage(urls ...string) Message {
+  content := TextContent("What is in these images?")
+  for _, url := range urls {
+    content = append(content, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}})
+  }
+  return Message{Role: "user", Content: content}
+}
+
+func TestInlineImageURLs(t *testing.T) {
+  allowLoopback(t)
+  var hits int32
+  server := imageServer(t, &hits, 100)
+
+  body := RequestBody{Messages: []Message{imageMessage(server.URL+"/a.png", "data:image/png;base64,AAAA")}}
+  inlined, err := inlineImageURLs(context.Background(), body)
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if hits != 1 {
+    t.Errorf("fetched %d times, want once", hits)
+  }
+  if hasImageURLs(inlined) {
+    t.Error("an image URL was left")
+  }
+  if !hasImageURLs(body) {
+    t.Error("the original request was changed")
+  }
+  if url := inlined.Messages[0].Content[2].ImageURL.URL; url != "data:image/png;base64,AAAA" {
+    t.Errorf("data URL changed to %q", url)
+  }
+}
+
+func TestInlineImageURLsSharesOneBudget(t *testing.T) {
+  allowLoopback(t)
+  var hits int32
+  server := imageServer(t, &hits, 8<<20)
+
+  body := RequestBody{Messages: []Message{imageMessage(server.URL+"/1", server.URL+"/2", server.URL+"/3")}}
+  if _, err := inlineImageURLs(context.Background(), body); err == nil || !strings.Contains(err.Error(), "20MB per request") {
+    t.Errorf("got error %v, want the request budget exceeded", err)
+  }
+  if hits != 3 {
+    t.Errorf("fetched %d images, want to stop at the third", hits)
+  }
+}
+
+func TestInlineImageURLsUsesRequestContext(t *testing.T) {
+  allowLoopback(t)
+  var hits int32
+  server := imageServer(t, &hits, 100)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  body := RequestBody{Messages: []Message{imageMessage(server.URL)}}
+  if _, err := inlineImageURLs(ctx, body); err == nil {
+    t.Error("a cancelled request still fetched its images")
+  }
+}
+
+func TestValidateContentRejectsEmptyMessages(t *testing.T) {
+  image := ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,AAAA"}}
+  call := ToolCall{ID: "call_1", Type: "function", Function: ToolCallFunction{Name: "lookup", Arguments: "{}"}}
+  tests := []struct {
+    name string
+    messages []Message
+    valid bool
+  }{
+    {"text", []Message{{Role: "user", Content: TextContent("Hi")}}, true},
+    {"image only", []Message{{Role: "user", Content: MessageContent{image}}}, true},
+    {"blank text and image", []Message{{Role: "user", Content: MessageContent{{Type: "text", Text: " "}, image}}}, true},
+    {"tool calls only", []Message{{Role: "user", Content: TextContent("Hi")}, {Role: "assistant", ToolCalls: []ToolCall{call}}}, true},
+    {"empty tool result", []Message{{Role: "assistant", ToolCalls: []ToolCall{call}}, {Role: "tool", ToolCallID: "call_1"}}, true},
+    {"empty string", []Message{{Role: "user", Content: TextContent("")}}, false},
+    {"blank string", []Message{{Role: "user", Content: TextContent(" \n")}}, false},
+    {"null content", []Message{{Role: "assistant"}}, false},
+    {"no parts", []Message{{Role: "user", Content: MessageContent{}}}, false},
+  }
+  for _, test := range tests {
+    err := validateContent(RequestBody{Messages: test.messages})
+    if (err == nil) != test.valid {
+      t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+    }
+  }
+}
+
+func TestImagesWithBlankTextBuildNoEmptyParts(t *testing.T) {
+  content := MessageContent{{Type: "text", Text: ""}, {Type: "image_url", ImageURL: &ImageURL{URL: "data:image/png;base64,AAAA"}}}
+  for _, part := range geminiContentParts(content) {
+    if part.Text == "" && part.InlineData == nil {
+      t.Error("Gemini got an empty part")
+    }
+  }
+  for _, block := range anthropicContentBlocks(content) {
+    if block.Type == "text" && block.Text == "" {
+      t.Error("Anthropic got an empty text block")
+    }
+  }
+}
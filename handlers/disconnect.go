@@ -0,0 +1,43 @@
+package handlers
+
+import (
+  "context"
+  "net"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// How often an open request checks whether its client is still there
+const disconnectPollInterval = 250 * time.Millisecond
+
+// CancelOnDisconnect gives the request a context that is cancelled when the
+// client closes its connection, so upstream calls and their retries stop
+// instead of running for nobody. fasthttp doesn't read the connection while a
+// handler runs, so the socket is peeked at instead. The context doesn't derive
+// from fasthttp's RequestCtx, which is reused once the handler returns.
+func CancelOnDisconnect(c *fiber.Ctx) error {
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+
+  c.SetUserContext(ctx)
+  go watchDisconnect(ctx, cancel, c.Context().Conn())
+  return c.Next()
+}
+
+func watchDisconnect(ctx context.Context, cancel context.CancelFunc, conn net.Conn) {
+  ticker := time.NewTicker(disconnectPollInterval)
+  defer ticker.Stop()
+
+  for {
+    select {
+    case <-ctx.Done():
+      return
+    case <-ticker.C:
+      if connClosed(conn) {
+        cancel()
+        return
+      }
+    }
+  }
+}
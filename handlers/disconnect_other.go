@@ -0,0 +1,10 @@
+//go:build !unix
+
+package handlers
+
+import "net"
+
+// Client disconnects are only detected on unix
+func connClosed(conn net.Conn) bool {
+  return false
+}
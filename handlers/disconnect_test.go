@@ -0,0 +1,126 @@
+//go:build unix
+
+package handlers
+
+import (
+  "context"
+  "net"
+  "net/http"
+  "testing"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+  t.Helper()
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer listener.Close()
+
+  client, err := net.Dial("tcp", listener.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  server, err := listener.Accept()
+  if err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    client.Close()
+    server.Close()
+  })
+  return client, server
+}
+
+func TestConnClosed(t *testing.T) {
+  client, server := tcpPair(t)
+  if connClosed(server) {
+    t.Fatal("open connection reported closed")
+  }
+
+  // Pipelined data is only peeked at, the server still reads it
+  client.Write([]byte("GET"))
+  time.Sleep(50 * time.Millisecond)
+  if connClosed(server) {
+    t.Fatal("connection with unread data reported closed")
+  }
+  buffer := make([]byte, 3)
+  if n, _ := server.Read(buffer); string(buffer[:n]) != "GET" {
+    t.Fatalf("peeking consumed data, read %q", buffer[:n])
+  }
+
+  client.Close()
+  time.Sleep(50 * time.Millisecond)
+  if !connClosed(server) {
+    t.Error("closed connection reported open")
+  }
+}
+
+func TestWatchDisconnectCancels(t *testing.T) {
+  client, server := tcpPair(t)
+  ctx, cancel := context.WithCancel(context.Background())
+  defer cancel()
+  go watchDisconnect(ctx, cancel, server)
+
+  client.Close()
+  select {
+  case <-ctx.Done():
+  case <-time.After(2 * time.Second):
+    t.Fatal("context wasn't cancelled after the client hung up")
+  }
+}
+
+func TestUpstreamCallCancelledByClient(t *testing.T) {
+  release := make(chan struct{})
+  defer close(release)
+  newStandIn(t, testUpstreamConfig, func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-release:
+    case <-r.Context().Done():
+    }
+  })
+
+  ctx, cancel := context.WithCancel(context.Background())
+  time.AfterFunc(50*time.Millisecond, cancel)
+  _, statusCode, err := OpenAIResponseJSON(ctx, testOpenAIBody())
+  if statusCode != statusClientClosed || err == nil {
+    t.Errorf("got status %d, error %v, want %d", statusCode, err, statusClientClosed)
+  }
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+  cancelled := make(chan struct{})
+  app := fiber.New(fiber.Config{DisableStartupMessage: true})
+  app.Post("/slow", CancelOnDisconnect, func(c *fiber.Ctx) error {
+    select {
+    case <-requestContext(c).Done():
+      close(cancelled)
+    case <-time.After(5 * time.Second):
+    }
+    return nil
+  })
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go app.Listener(listener)
+  defer app.Shutdown()
+
+  client, err := net.Dial("tcp", listener.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  client.Write([]byte("POST /slow HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\n\r\n"))
+  time.Sleep(100 * time.Millisecond)
+  client.Close()
+
+  select {
+  case <-cancelled:
+  case <-time.After(3 * time.Second):
+    t.Fatal("the request context wasn't cancelled after the client hung up")
+  }
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package handlers
+
+import (
+  "net"
+  "syscall"
+)
+
+// connClosed peeks at the socket without consuming anything, a read of 0
+// bytes means the client hung up. TLS connections can't be peeked at and
+// are reported open.
+func connClosed(conn net.Conn) bool {
+  syscallConn, ok := conn.(syscall.Conn)
+  if !ok {
+    return false
+  }
+  raw, err := syscallConn.SyscallConn()
+  if err != nil {
+    return false
+  }
+
+  closed := false
+  var buffer [1]byte
+  raw.Read(func(fd uintptr) bool {
+    n, _, err := syscall.Recvfrom(int(fd), buffer[:], syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+    closed = n == 0 && err == nil || err == syscall.ECONNRESET
+    return true
+  })
+  return closed
+}
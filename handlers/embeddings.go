@@ -0,0 +1,311 @@
+package handlers
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// Most inputs each provider embeds in one call
+var maxEmbeddingInputs = map[string]int{
+  "openai": 2048,
+  "google": 100,
+}
+
+// EmbeddingRequest follows OpenAI's embeddings schema for every provider
+type EmbeddingRequest struct {
+  ID string `json:"id_user,omitempty"`
+  Model string `json:"model"`
+  Input EmbeddingInput `json:"input"`
+  // Dimensions shortens the vectors, if the model supports it
+  Dimensions int `json:"dimensions,omitempty"`
+}
+
+// EmbeddingInput is a single string or an array of strings
+type EmbeddingInput []string
+
+func (input *EmbeddingInput) UnmarshalJSON(data []byte) error {
+  var text string
+  if err := json.Unmarshal(data, &text); err == nil {
+    *input = EmbeddingInput{text}
+    return nil
+  }
+
+  var texts []string
+  if err := json.Unmarshal(data, &texts); err != nil {
+    return errors.New("input must be a string or an array of strings")
+  }
+  *input = texts
+  return nil
+}
+
+// EmbeddingResponse is OpenAI's response, Gemini's is translated into it
+type EmbeddingResponse struct {
+  Object string `json:"object"`
+  Data []Embedding `json:"data"`
+  Model string `json:"model"`
+  Usage EmbeddingUsage `json:"usage"`
+}
+
+type Embedding struct {
+  Object string `json:"object"`
+  Index int `json:"index"`
+  Embedding []float64 `json:"embedding"`
+}
+
+type EmbeddingUsage struct {
+  PromptTokens int `json:"prompt_tokens"`
+  TotalTokens int `json:"total_tokens"`
+}
+
+// openai-specific structures
+type OAIEmbeddingRequestBody struct {
+  Model string `json:"model"`
+  Input []string `json:"input"`
+  Dimensions int `json:"dimensions,omitempty"`
+}
+
+// gemini-specific structures
+type GEmbedRequest struct {
+  Model string `json:"model"`
+  Content Content `json:"content"`
+  OutputDimensionality int `json:"outputDimensionality,omitempty"`
+}
+
+type GBatchEmbedRequestBody struct {
+  Requests []GEmbedRequest `json:"requests"`
+}
+
+func newEmbeddingsRequest(company string, path string, requestBody interface{}) (*http.Request, error) {
+  // Check the API keys and set the endpoint, the key is added per attempt
+  provider, _ := getProvider(company)
+  if !getKeyPool(company).configured() {
+    return nil, fiber.NewError(fiber.StatusInternalServerError, provider.(KeyedProvider).APIKeyEnv()+" is not set")
+  }
+  url := upstreamURL(company, path)
+
+  // Convert request body to JSON
+  jsonBody, err := json.Marshal(requestBody)
+  if err != nil {
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error marshalling JSON")
+  }
+
+  // Make HTTP request
+  req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
+  if err != nil {
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
+  }
+
+  // Add headers
+  req.Header.Set("Content-Type", "application/json")
+
+  return req, nil
+}
+
+func OpenAIEmbeddingsJSON(ctx context.Context, request EmbeddingRequest) ([]byte, int, error) {
+  req, err := newEmbeddingsRequest("openai", "/v1/embeddings", OAIEmbeddingRequestBody{
+    Model: request.Model,
+    Input: request.Input,
+    Dimensions: request.Dimensions,
+  })
+  if err != nil {
+    return nil, http.StatusInternalServerError, err
+  }
+
+  // Send request
+  return upstreamCall(ctx, "openai", req)
+}
+
+// GoogleEmbeddingsJSON embeds every input with a single batchEmbedContents call
+func GoogleEmbeddingsJSON(ctx context.Context, request EmbeddingRequest) ([]byte, int, error) {
+  requestBody := GBatchEmbedRequestBody{}
+  for _, text := range request.Input {
+    requestBody.Requests = append(requestBody.Requests, GEmbedRequest{
+      Model: "models/" + request.Model,
+      Content: Content{Parts: []Part{{Text: text}}},
+      OutputDimensionality: request.Dimensions,
+    })
+  }
+
+  req, err := newEmbeddingsRequest("google", fmt.Sprintf("/v1beta/models/%s:batchEmbedContents", request.Model), requestBody)
+  if err != nil {
+    return nil, http.StatusInternalServerError, err
+  }
+
+  // Send request
+  return upstreamCall(ctx, "google", req)
+}
+
+// Gemini doesn't report the tokens it embedded, so they are estimated like
+// budget checks do
+func estimateEmbeddingTokens(input EmbeddingInput) int {
+  tokens := 0
+  for _, text := range input {
+    tokens += len(text)/4 + 1
+  }
+  return tokens
+}
+
+func translateGoogleEmbeddings(response []byte, request EmbeddingRequest) (EmbeddingResponse, error) {
+  var googleResponse struct {
+    Embeddings []struct {
+      Values []float64 `json:"values"`
+    } `json:"embeddings"`
+  }
+  if err := json.Unmarshal(response, &googleResponse); err != nil {
+    return EmbeddingResponse{}, err
+  }
+
+  tokens := estimateEmbeddingTokens(request.Input)
+  embeddings := EmbeddingResponse{
+    Object: "list",
+    Data: []Embedding{},
+    Model: request.Model,
+    Usage: EmbeddingUsage{PromptTokens: tokens, TotalTokens: tokens},
+  }
+  for i, embedding := range googleResponse.Embeddings {
+    embeddings.Data = append(embeddings.Data, Embedding{Object: "embedding", Index: i, Embedding: embedding.Values})
+  }
+  return embeddings, nil
+}
+
+// EmbeddingsHandler embeds one or more inputs with an OpenAI or Gemini
+// embeddings model and bills the tokens like any other call
+func EmbeddingsHandler(c *fiber.Ctx) error {
+  // Read request body
+  var request EmbeddingRequest
+  if err := c.BodyParser(&request); err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "Cannot parse JSON",
+    })
+  }
+  userID := requestUserID(c, request.ID)
+
+  // Get the model's price from the catalog
+  company, price, err := getEmbeddingPrice(request.Model)
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s is not an embeddings model", request.Model),
+    })
+  }
+
+  if len(request.Input) == 0 {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "input is required",
+    })
+  }
+  if len(request.Input) > maxEmbeddingInputs[company] {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": fmt.Sprintf("%s embeds at most %d inputs per call", company, maxEmbeddingInputs[company]),
+    })
+  }
+  for _, text := range request.Input {
+    if text == "" {
+      return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+        "error": "input can't contain empty strings",
+      })
+    }
+  }
+  if request.Dimensions < 0 {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "dimensions must be positive",
+    })
+  }
+
+  // Check if the user exists before spending on the upstream call
+  user, err := findUser(userID)
+  if err != nil {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "User not found",
+    })
+  }
+
+  // Reject the call if its estimated cost would break a budget
+  estimate := float64(estimateEmbeddingTokens(request.Input)) * (price.Input / 1000000)
+  if rejected, err := enforceBudget(c, user, company, request.Model, estimate); rejected {
+    return err
+  }
+
+  // Fail fast while the provider or model is known to be down
+  if !breakerAllow(company, request.Model) {
+    return breakerOpenResponse(c, completionTarget{Company: company, Model: request.Model})
+  }
+
+  // Make the provider request
+  ctx, tracker := withKeyTracker(requestContext(c))
+  var response []byte
+  var statusCode int
+  if company == "google" {
+    response, statusCode, err = GoogleEmbeddingsJSON(ctx, request)
+  } else {
+    response, statusCode, err = OpenAIEmbeddingsJSON(ctx, request)
+  }
+  breakerReport(company, request.Model, statusCode, err)
+  if err != nil {
+    return c.Status(statusCode).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  // If request is not successful, don't update the database
+  if statusCode != http.StatusOK {
+    return c.Status(statusCode).Send(response)
+  }
+
+  // OpenAI's response is sent as is, Gemini's is translated
+  var tokens int
+  if company == "google" {
+    embeddings, err := translateGoogleEmbeddings(response, request)
+    if err == nil {
+      tokens = embeddings.Usage.PromptTokens
+      response, err = json.Marshal(embeddings)
+    }
+    if err != nil {
+      return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+        "error": "Error parsing response JSON",
+      })
+    }
+  } else {
+    var embeddings EmbeddingResponse
+    if err := json.Unmarshal(response, &embeddings); err != nil {
+      return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+        "error": "Error parsing response JSON",
+      })
+    }
+    tokens = embeddings.Usage.PromptTokens
+  }
+
+  if err := recordUsage(userID, company, request.Model, tracker.Label(), TokenUsage{InputTokens: tokens}, price); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+
+  c.Set("Content-Type", "application/json")
+  return c.Send(response)
+}
+
+// Helper function to look up the company and current price of an embeddings model
+func getEmbeddingPrice(model string) (string, ModelPrice, error) {
+  catalog := currentCatalog()
+  company, exists := catalog.FindCompany(model)
+  if !exists {
+    return "", ModelPrice{}, fmt.Errorf("model not found")
+  }
+
+  spec, _ := catalog.Model(company, model)
+  if !spec.HasCapability("embeddings") || spec.PricePerTokens == nil || maxEmbeddingInputs[company] == 0 {
+    log.Printf("Model %s of company %s is not an embeddings model", model, company)
+    return "", ModelPrice{}, fmt.Errorf("embeddings model not found")
+  }
+
+  return company, spec.PriceAt(time.Now()), nil
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+  "context"
+  "fmt"
+  "log"
+  "time"
+
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo"
+  "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var usageCollection *mongo.Collection
+
+// recordEvent stores a billed call in the usage_events collection
+func recordEvent(event History) error {
+  now := time.Now()
+  event.Created = now.Unix()
+  event.Timestamp = now.UTC()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  _, err := usageCollection.InsertOne(ctx, event)
+  return err
+}
+
+// ensureUsageIndexes indexes events by user and time, and expires them after
+// retentionDays when it is set
+func ensureUsageIndexes(ctx context.Context, retentionDays int) {
+  _, err := usageCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+    Keys: bson.D{{Key: "id_user", Value: 1}, {Key: "timestamp", Value: -1}},
+  })
+  if err != nil {
+    log.Printf("Error creating usage_events index: %v", err)
+  }
+
+  if retentionDays <= 0 {
+    return
+  }
+  _, err = usageCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+    Keys: bson.D{{Key: "timestamp", Value: 1}},
+    Options: options.Index().SetName("usage_events_retention").SetExpireAfterSeconds(int32(retentionDays * 24 * 60 * 60)),
+  })
+  if err != nil {
+    // An existing TTL index with a different retention has to be dropped first
+    log.Printf("Error creating usage_events retention index: %v", err)
+  }
+}
+
+// MigrateHistory moves the history arrays embedded in user documents into
+// usage_events. Migrated events get deterministic IDs so the command can be
+// re-run safely after a partial failure.
+func MigrateHistory(ctx context.Context) (int, int, error) {
+  cursor, err := userCollection.Find(ctx, bson.M{"history.0": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"id_user": 1, "history": 1}))
+  if err != nil {
+    return 0, 0, err
+  }
+  defer cursor.Close(ctx)
+
+  users, events := 0, 0
+  for cursor.Next(ctx) {
+    var user struct {
+      ID string `bson:"id_user"`
+      History []bson.M `bson:"history"`
+    }
+    if err := cursor.Decode(&user); err != nil {
+      return users, events, err
+    }
+
+    var documents []interface{}
+    for i, entry := range user.History {
+      document := migratedEvent(user.ID, entry)
+      document["_id"] = fmt.Sprintf("%s:%d", user.ID, i)
+      documents = append(documents, document)
+    }
+
+    _, err := usageCollection.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+    if err != nil && !onlyDuplicateKeyErrors(err) {
+      return users, events, err
+    }
+
+    _, err = userCollection.UpdateOne(ctx, bson.M{"id_user": user.ID}, bson.M{"$unset": bson.M{"history": ""}})
+    if err != nil {
+      return users, events, err
+    }
+
+    users++
+    events += len(documents)
+  }
+
+  return users, events, cursor.Err()
+}
+
+// Entries written before the bson tags existed use lowercased field names
+func migratedEvent(userID string, entry bson.M) bson.M {
+  field := func(names ...string) interface{} {
+    for _, name := range names {
+      if value, ok := entry[name]; ok {
+        return value
+      }
+    }
+    return 0
+  }
+
+  created := toInt64(field("created"))
+  return bson.M{
+    "id_user": userID,
+    "company": field("company"),
+    "model": field("model"),
+    "input_tokens": field("input_tokens", "inputtokens"),
+    "output_tokens": field("output_tokens", "outputtokens"),
+    "audio_seconds": field("audio_seconds", "audioseconds"),
+    "input_usage": field("input_usage", "inputusage"),
+    "output_usage": field("output_usage", "outputusage"),
+    "created": created,
+    "timestamp": time.Unix(created, 0).UTC(),
+  }
+}
+
+func toInt64(value interface{}) int64 {
+  switch v := value.(type) {
+  case int64:
+    return v
+  case int32:
+    return int64(v)
+  case float64:
+    return int64(v)
+  }
+  return 0
+}
+
+func onlyDuplicateKeyErrors(err error) bool {
+  bulkErr, ok := err.(mongo.BulkWriteException)
+  if !ok || bulkErr.WriteConcernError != nil {
+    return false
+  }
+  for _, writeErr := range bulkErr.WriteErrors {
+    if writeErr.Code != 11000 {
+      return false
+    }
+  }
+  return true
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "os"
+)
+
+// Helper function to load the fallback chains from fallbacks.json, a missing
+// file means no model falls back
+func loadFallbacks() (map[string][]string, error) {
+  var fallbacks map[string][]string
+  fallbacksFile, err := os.ReadFile("services/fallbacks.json")
+  if errors.Is(err, os.ErrNotExist) {
+    return nil, nil
+  }
+  if err != nil {
+    log.Printf("Error reading fallbacks.json: %v", err)
+    return nil, err
+  }
+  err = json.Unmarshal(fallbacksFile, &fallbacks)
+  if err != nil {
+    log.Printf("Error unmarshalling fallbacks.json: %v", err)
+    return nil, err
+  }
+  return fallbacks, nil
+}
+
+// fallbackTargets resolves the models to try after the requested one. The
+// body's fallback list overrides fallbacks.json, an empty list disables it.
+// Unknown models and models the user's hard budget can't cover are skipped.
+func fallbackTargets(requestBody RequestBody, user User) []completionTarget {
+  var chain []string
+  if requestBody.Fallback != nil {
+    chain = *requestBody.Fallback
+  } else {
+    fallbacks, err := loadFallbacks()
+    if err != nil {
+      return nil
+    }
+    chain = fallbacks[requestBody.Model]
+  }
+
+  var targets []completionTarget
+  for _, model := range chain {
+    if model == requestBody.Model {
+      continue
+    }
+
+    company, err := findModelCompany(model)
+    if err != nil {
+      log.Printf("Skipping unknown fallback model %s", model)
+      continue
+    }
+    if _, ok := getProvider(company); !ok {
+      continue
+    }
+    price, err := getModelPrices(model, company)
+    if err != nil {
+      continue
+    }
+
+    estimate := estimateCost(requestBody, estimatedOutputTokens, price.Input, price.Output)
+    if _, exceeded := checkBudget(user, company, model, estimate); exceeded && !user.Budget.SoftLimit {
+      continue
+    }
+
+    targets = append(targets, completionTarget{Company: company, Model: model, Price: price})
+  }
+  return targets
+}
+
+// compatibleFallback reports whether a fallback can take the request as it
+// is, image URLs don't count as they are fetched for the providers that need
+// them inline
+func compatibleFallback(target completionTarget, body RequestBody, stream bool) bool {
+  provider, ok := getProvider(target.Company)
+  if !ok {
+    return false
+  }
+  if _, ok := provider.(StreamProvider); stream && !ok {
+    return false
+  }
+  if requestHasImages(body) && !readsImages(target.Company, target.Model) {
+    return false
+  }
+
+  body.Model = target.Model
+  if _, err := provider.BuildRequest(body); err != nil && !errors.Is(err, errImageURLs) {
+    log.Printf("Skipping fallback %s/%s: %v", target.Company, target.Model, err)
+    return false
+  }
+  return true
+}
+
+// Rate limits, overloads and server errors are worth another provider
+func shouldFallback(statusCode int) bool {
+  switch statusCode {
+  case http.StatusTooManyRequests, 529:
+    return true
+  }
+  return statusCode >= 500
+}
+
+func logFallback(target completionTarget, statusCode int, err error) {
+  if err != nil {
+    log.Printf("%s/%s failed: %v, falling back", target.Company, target.Model, err)
+    return
+  }
+  log.Printf("%s/%s answered %d, falling back", target.Company, target.Model, statusCode)
+}
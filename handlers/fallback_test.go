@@ -0,0 +1,50 @@
+package handlers
+
+import (
+  "context"
+  "testing"
+)
+
+// plainProvider can't stream
+type plainProvider struct{}
+
+func (plainProvider) BuildRequest(body RequestBody) (interface{}, error) {
+  return body, nil
+}
+
+func (plainProvider) Call(ctx context.Context, payload interface{}) ([]byte, int, error) {
+  return nil, 0, nil
+}
+
+func (plainProvider) ParseUsage(response []byte) (TokenUsage, error) {
+  return TokenUsage{}, nil
+}
+
+func TestCompatibleFallback(t *testing.T) {
+  RegisterProvider("plain", plainProvider{})
+  t.Cleanup(func() { delete(providers, "plain") })
+
+  prompt := "Hi"
+  temperature := 1.5
+  hot := RequestBody{Prompt: &prompt, Generation: &Generation{Temperature: &temperature}}
+  tests := []struct {
+    name string
+    target completionTarget
+    body RequestBody
+    stream bool
+    compatible bool
+  }{
+    {"openai takes temperature 1.5", completionTarget{Company: "openai", Model: "gpt-4o"}, hot, false, true},
+    {"google takes temperature 1.5", completionTarget{Company: "google", Model: "gemini-1.5-pro"}, hot, false, true},
+    {"anthropic caps temperature at 1", completionTarget{Company: "anthropic", Model: "claude-3-haiku-20240307"}, hot, false, false},
+    {"anthropic without temperature", completionTarget{Company: "anthropic", Model: "claude-3-haiku-20240307"}, RequestBody{Prompt: &prompt}, false, true},
+    {"provider without streaming", completionTarget{Company: "plain", Model: "plain"}, RequestBody{Prompt: &prompt}, true, false},
+    {"provider without streaming, not streamed", completionTarget{Company: "plain", Model: "plain"}, RequestBody{Prompt: &prompt}, false, true},
+    {"unregistered provider", completionTarget{Company: "missing", Model: "missing"}, RequestBody{Prompt: &prompt}, false, false},
+  }
+  for _, test := range tests {
+    if got := compatibleFallback(test.target, test.body, test.stream); got != test.compatible {
+      t.Errorf("%s: got %v, want %v", test.name, got, test.compatible)
+    }
+  }
+}
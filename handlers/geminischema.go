@@ -0,0 +1,193 @@
+package handlers
+
+import (
+  "encoding/json"
+)
+
+// Formats Gemini accepts, other formats are dropped
+var geminiFormats = map[string]bool{
+  "enum": true,
+  "date-time": true,
+  "int32": true,
+  "int64": true,
+  "float": true,
+  "double": true,
+}
+
+// Numeric keywords Gemini accepts as they are
+var geminiLimits = []string{"minItems", "maxItems", "minimum", "maximum"}
+
+// geminiSchema translates a JSON Schema into the OpenAPI subset Gemini takes
+// for function parameters and response_schema. Local $refs are inlined,
+// oneOf becomes anyOf, const a one value enum and a "null" type nullable.
+// Keywords Gemini rejects, such as $defs, title, default, pattern or
+// additionalProperties, are dropped: the full schema is still what outputs
+// are validated against.
+func geminiSchema(schema json.RawMessage) json.RawMessage {
+  if len(schema) == 0 {
+    return nil
+  }
+  root, err := decodeJSON(schema)
+  if err != nil {
+    return schema
+  }
+
+  translator := &geminiSchemaTranslator{resolver: &schemaValidator{root: root}, expanding: map[string]bool{}}
+  translated, _ := json.Marshal(translator.translate(root))
+  return translated
+}
+
+type geminiSchemaTranslator struct {
+  resolver *schemaValidator
+  // expanding holds the $refs being inlined, to stop at recursive ones
+  expanding map[string]bool
+}
+
+func (t *geminiSchemaTranslator) translate(schema interface{}) map[string]interface{} {
+  rules, ok := schema.(map[string]interface{})
+  if !ok {
+    return map[string]interface{}{}
+  }
+
+  if ref, ok := rules["$ref"].(string); ok {
+    // Gemini has no references, a recursive schema is cut at the first repeat
+    if t.expanding[ref] {
+      return map[string]interface{}{"type": "object"}
+    }
+    target, ok := t.resolver.resolve(ref)
+    if !ok {
+      return map[string]interface{}{}
+    }
+    t.expanding[ref] = true
+    result := t.translate(target)
+    delete(t.expanding, ref)
+    if description, ok := rules["description"].(string); ok {
+      result["description"] = description
+    }
+    return result
+  }
+
+  result := map[string]interface{}{}
+  if description, ok := rules["description"].(string); ok {
+    result["description"] = description
+  }
+
+  switch types := rules["type"].(type) {
+  case string:
+    if types == "null" {
+      result["nullable"] = true
+    } else {
+      result["type"] = types
+    }
+  case []interface{}:
+    var named []interface{}
+    for _, name := range types {
+      if name == "null" {
+        result["nullable"] = true
+      } else {
+        named = append(named, map[string]interface{}{"type": name})
+      }
+    }
+    if len(named) == 1 {
+      result["type"] = named[0].(map[string]interface{})["type"]
+    } else if len(named) > 1 {
+      result["anyOf"] = named
+    }
+  }
+  if nullable, _ := rules["nullable"].(bool); nullable {
+    result["nullable"] = true
+  }
+
+  // Gemini's enums are strings
+  if options, ok := rules["enum"].([]interface{}); ok {
+    if values, ok := stringValues(options); ok {
+      result["type"], result["enum"] = "string", values
+    }
+  }
+  if constant, ok := rules["const"].(string); ok {
+    result["type"], result["enum"] = "string", []string{constant}
+  }
+  if format, ok := rules["format"].(string); ok && geminiFormats[format] {
+    result["format"] = format
+  }
+  for _, keyword := range geminiLimits {
+    if limit, ok := rules[keyword].(json.Number); ok {
+      result[keyword] = limit
+    }
+  }
+
+  // Property names are kept as they are, only their schemas are translated
+  if properties, ok := rules["properties"].(map[string]interface{}); ok {
+    translated := map[string]interface{}{}
+    for name, property := range properties {
+      translated[name] = t.translate(property)
+    }
+    result["properties"] = translated
+  }
+  if required, ok := rules["required"].([]interface{}); ok {
+    result["required"] = required
+  }
+  if items, ok := rules["items"]; ok {
+    result["items"] = t.translate(items)
+  }
+
+  alternatives := append(schemaList(rules["anyOf"]), schemaList(rules["oneOf"])...)
+  if len(alternatives) > 0 {
+    var options []interface{}
+    for _, alternative := range alternatives {
+      translated := t.translate(alternative)
+      // {"type": "null"} only makes the value nullable
+      if len(translated) == 1 && translated["nullable"] == true {
+        result["nullable"] = true
+        continue
+      }
+      options = append(options, translated)
+    }
+    if len(options) == 1 {
+      mergeGeminiSchema(result, options[0].(map[string]interface{}))
+    } else if len(options) > 1 {
+      result["anyOf"] = options
+    }
+  }
+  for _, subschema := range schemaList(rules["allOf"]) {
+    mergeGeminiSchema(result, t.translate(subschema))
+  }
+  return result
+}
+
+// mergeGeminiSchema adds the keywords of from to into, properties and
+// required are combined
+func mergeGeminiSchema(into map[string]interface{}, from map[string]interface{}) {
+  for key, value := range from {
+    switch key {
+    case "properties":
+      properties, _ := into["properties"].(map[string]interface{})
+      if properties == nil {
+        properties = map[string]interface{}{}
+      }
+      for name, property := range value.(map[string]interface{}) {
+        properties[name] = property
+      }
+      into["properties"] = properties
+    case "required":
+      required, _ := into["required"].([]interface{})
+      into["required"] = append(required, value.([]interface{})...)
+    default:
+      if _, ok := into[key]; !ok {
+        into[key] = value
+      }
+    }
+  }
+}
+
+func stringValues(options []interface{}) ([]string, bool) {
+  values := make([]string, len(options))
+  for i, option := range options {
+    value, ok := option.(string)
+    if !ok {
+      return nil, false
+    }
+    values[i] = value
+  }
+  return values, true
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+  "encoding/json"
+  "testing"
+)
+
+func TestGeminiSchema(t *testing.T) {
+  tests := []struct {
+    name string
+    schema string
+    want string
+  }{
+    {"keyword named properties are kept", `{"type": "object", "properties": {"strict": {"type": "boolean"}, "additionalProperties": {"type": "string"}, "name": {"type": "string"}}, "required": ["strict", "additionalProperties", "name"], "additionalProperties": false, "strict": true}`, `{"type": "object", "properties": {"strict": {"type": "boolean"}, "additionalProperties": {"type": "string"}, "name": {"type": "string"}}, "required": ["strict", "additionalProperties", "name"]}`},
+    {"unsupported keywords dropped", `{"$schema": "https://json-schema.org/draft/2020-12/schema", "title": "T", "type": "string", "default": "x", "pattern": "^a", "format": "email", "description": "d"}`, `{"type": "string", "description": "d"}`},
+    {"supported format kept", `{"type": "string", "format": "date-time"}`, `{"type": "string", "format": "date-time"}`},
+    {"refs inlined", `{"$defs": {"zip": {"type": "string", "description": "zip code"}}, "type": "object", "properties": {"zip": {"$ref": "#/$defs/zip"}}}`, `{"type": "object", "properties": {"zip": {"type": "string", "description": "zip code"}}}`},
+    {"definitions inlined", `{"definitions": {"n": {"type": "integer", "minimum": 1}}, "type": "array", "items": {"$ref": "#/definitions/n"}, "maxItems": 3}`, `{"type": "array", "items": {"type": "integer", "minimum": 1}, "maxItems": 3}`},
+    {"recursive ref cut", `{"type": "object", "properties": {"child": {"$ref": "#"}}}`, `{"type": "object", "properties": {"child": {"type": "object", "properties": {"child": {"type": "object"}}}}}`},
+    {"unknown ref", `{"$ref": "#/$defs/missing"}`, `{}`},
+    {"const becomes enum", `{"const": "yes"}`, `{"type": "string", "enum": ["yes"]}`},
+    {"numeric enum dropped", `{"type": "integer", "enum": [1, 2]}`, `{"type": "integer"}`},
+    {"oneOf becomes anyOf", `{"oneOf": [{"type": "string"}, {"type": "integer"}]}`, `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`},
+    {"null alternative is nullable", `{"anyOf": [{"type": "string"}, {"type": "null"}]}`, `{"type": "string", "nullable": true}`},
+    {"type list is nullable", `{"type": ["integer", "null"]}`, `{"type": "integer", "nullable": true}`},
+    {"type list becomes anyOf", `{"type": ["integer", "string"]}`, `{"anyOf": [{"type": "integer"}, {"type": "string"}]}`},
+    {"allOf merged", `{"allOf": [{"type": "object", "properties": {"a": {"type": "string"}}, "required": ["a"]}, {"properties": {"b": {"type": "number"}}, "required": ["b"]}]}`, `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": "number"}}, "required": ["a", "b"]}`},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      got := geminiSchema(json.RawMessage(test.schema))
+      if !sameJSON(t, got, test.want) {
+        t.Fatalf("got %s, want %s", got, test.want)
+      }
+    })
+  }
+}
+
+func TestGeminiSchemaEmpty(t *testing.T) {
+  if got := geminiSchema(nil); got != nil {
+    t.Fatalf("got %s, want nil", got)
+  }
+}
+
+func sameJSON(t *testing.T, got json.RawMessage, want string) bool {
+  t.Helper()
+  var gotValue, wantValue interface{}
+  if err := json.Unmarshal(got, &gotValue); err != nil {
+    t.Fatalf("decode %s: %v", got, err)
+  }
+  if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+    t.Fatalf("decode %s: %v", want, err)
+  }
+  gotJSON, _ := json.Marshal(gotValue)
+  wantJSON, _ := json.Marshal(wantValue)
+  return string(gotJSON) == string(wantJSON)
+}
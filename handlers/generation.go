@@ -0,0 +1,112 @@
+package handlers
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+)
+
+// Generation holds the sampling parameters shared by every provider
+type Generation struct {
+  Temperature *float64 `json:"temperature,omitempty"`
+  TopP *float64 `json:"top_p,omitempty"`
+  MaxTokens *int `json:"max_tokens,omitempty"`
+  Stop StopSequences `json:"stop,omitempty"`
+  Seed *int64 `json:"seed,omitempty"`
+  PresencePenalty *float64 `json:"presence_penalty,omitempty"`
+  FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+}
+
+// StopSequences is a single string or an array of strings
+type StopSequences []string
+
+func (stop *StopSequences) UnmarshalJSON(data []byte) error {
+  var sequence string
+  if err := json.Unmarshal(data, &sequence); err == nil {
+    *stop = StopSequences{sequence}
+    return nil
+  }
+
+  var sequences []string
+  if err := json.Unmarshal(data, &sequences); err != nil {
+    return errors.New("stop must be a string or an array of strings")
+  }
+  *stop = sequences
+  return nil
+}
+
+// generationLimits are the parameters and ranges a provider accepts
+type generationLimits struct {
+  MaxTemperature float64
+  // MaxStop is the most stop sequences, 0 means no limit
+  MaxStop int
+  Seed bool
+  Penalties bool
+}
+
+var (
+  openAIGeneration = generationLimits{MaxTemperature: 2, MaxStop: 4, Seed: true, Penalties: true}
+  googleGeneration = generationLimits{MaxTemperature: 2, MaxStop: 5, Seed: true, Penalties: true}
+  anthropicGeneration = generationLimits{MaxTemperature: 1}
+)
+
+// generation merges the generation block with the top level temperature, which
+// is still accepted, and checks it against the provider and the model's
+// max_output_tokens
+func (body RequestBody) generation(company string, limits generationLimits) (Generation, error) {
+  var generation Generation
+  if body.Generation != nil {
+    generation = *body.Generation
+  }
+  if generation.Temperature == nil {
+    generation.Temperature = body.Temperature
+  }
+
+  if temperature := generation.Temperature; temperature != nil && (*temperature < 0 || *temperature > limits.MaxTemperature) {
+    return generation, fmt.Errorf("%s accepts a temperature between 0 and %g", company, limits.MaxTemperature)
+  }
+  if topP := generation.TopP; topP != nil && (*topP < 0 || *topP > 1) {
+    return generation, errors.New("top_p must be between 0 and 1")
+  }
+  if maxTokens := generation.MaxTokens; maxTokens != nil {
+    if *maxTokens < 1 {
+      return generation, errors.New("max_tokens must be at least 1")
+    }
+    spec, _ := currentCatalog().Model(company, body.Model)
+    if spec.MaxOutputTokens > 0 && *maxTokens > spec.MaxOutputTokens {
+      return generation, fmt.Errorf("%s generates at most %d tokens", body.Model, spec.MaxOutputTokens)
+    }
+  }
+  if limits.MaxStop > 0 && len(generation.Stop) > limits.MaxStop {
+    return generation, fmt.Errorf("%s accepts at most %d stop sequences", company, limits.MaxStop)
+  }
+  for _, sequence := range generation.Stop {
+    if sequence == "" {
+      return generation, errors.New("stop sequences can't be empty")
+    }
+  }
+  if generation.Seed != nil && !limits.Seed {
+    return generation, fmt.Errorf("%s doesn't support seed", company)
+  }
+  for _, penalty := range []*float64{generation.PresencePenalty, generation.FrequencyPenalty} {
+    if penalty == nil {
+      continue
+    }
+    if !limits.Penalties {
+      return generation, fmt.Errorf("%s doesn't support presence or frequency penalties", company)
+    }
+    if *penalty < -2 || *penalty > 2 {
+      return generation, errors.New("presence_penalty and frequency_penalty must be between -2 and 2")
+    }
+  }
+  return generation, nil
+}
+
+// anthropicMaxTokensFor is the max_tokens sent when the caller gives none
+func anthropicMaxTokensFor(model string) int {
+  spec, _ := currentCatalog().Model("anthropic", model)
+  if spec.MaxOutputTokens > 0 {
+    return spec.MaxOutputTokens
+  }
+  return anthropicMaxTokens
+}
@@ -1,186 +1,252 @@
 package handlers
 
 import (
-  "context"
-  "time"
   "bytes"
+  "context"
   "encoding/json"
+  "errors"
   "net/http"
-  "os"
-  "log"
-  "io/ioutil"
   "fmt"
+  "reflect"
   "strings"
 
   "github.com/gofiber/fiber/v2"
-  "go.mongodb.org/mongo-driver/bson"
-  "go.mongodb.org/mongo-driver/mongo/options"
 )
 
 
-func GoogleResponseJSON(requestBody GRequestBody) ([]byte, int, error) {
-  // Set the Google API key and endpoint
-  GKey := os.Getenv("GEMINI_API_KEY")
-  if GKey == "" {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "GEMINI_API_KEY is not set")
+func newGoogleRequest(requestBody GRequestBody, method string) (*http.Request, error) {
+  // Check the Google API keys and set the endpoint, the key is added per attempt
+  if !getKeyPool("google").configured() {
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "GEMINI_API_KEY is not set")
   }
-  url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent?key=%s", requestBody.Model, GKey)
+  url := upstreamURL("google", fmt.Sprintf("/v1beta/models/%s:%s", requestBody.Model, method))
 
   // Convert request body to JSON
   jsonBody, err := json.Marshal(requestBody)
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error marshalling JSON")
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error marshalling JSON")
   }
 
   // Make HTTP request
   req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
   }
-  
+
   // Add header
   req.Header.Set("Content-Type", "application/json")
 
-  // Send request
-  client := &http.Client{}
-  resp, err := client.Do(req)
+  return req, nil
+}
+
+func GoogleResponseJSON(ctx context.Context, requestBody GRequestBody) ([]byte, int, error) {
+  req, err := newGoogleRequest(requestBody, "generateContent")
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error sending request")
+    return nil, http.StatusInternalServerError, err
   }
-  defer resp.Body.Close()
 
-  // Read response
-  body, err := ioutil.ReadAll(resp.Body)
+  // Send request
+  return upstreamCall(ctx, "google", req)
+}
+
+// GoogleStream opens a streamGenerateContent SSE stream, the caller closes the body
+func GoogleStream(ctx context.Context, requestBody GRequestBody) (*http.Response, error) {
+  req, err := newGoogleRequest(requestBody, "streamGenerateContent")
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error reading response")
+    return nil, err
   }
 
-  return body, resp.StatusCode, nil
+  // Ask for SSE framing instead of a JSON array
+  query := req.URL.Query()
+  query.Set("alt", "sse")
+  req.URL.RawQuery = query.Encode()
+
+  // Send request
+  return upstreamStream(ctx, "google", req)
 }
 
+type googleProvider struct{}
 
+// Gemini only reads inline data, it can't fetch image URLs
+func (googleProvider) InlineImages() bool {
+  return true
+}
 
-func GoogleHandler(c *fiber.Ctx) error {
-  // Read request body
-  var requestBody RequestBody
-  if err := c.BodyParser(&requestBody); err != nil {
-    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-      "error": "Cannot parse JSON",
-    })
+func (googleProvider) BuildRequest(body RequestBody) (interface{}, error) {
+  if hasImageURLs(body) {
+    return nil, fmt.Errorf("Gemini only reads inline images, %w", errImageURLs)
   }
-
-  // Validate if the model belongs to google
-  _, googleContents, err := processRequest(requestBody)
+  _, googleContents, err := processRequest(body)
+  if err != nil {
+    return nil, err
+  }
+  generation, err := body.generation("google", googleGeneration)
   if err != nil {
-    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-      "error": err.Error(),
-    })
+    return nil, err
   }
 
   // Create Google request body
   gRequestBody := GRequestBody{
-    Model: requestBody.Model,
+    Model: body.Model,
     Contents: googleContents,
   }
 
-  if requestBody.OutputJSON == nil || *requestBody.OutputJSON {
-    gRequestBody.GenerationConfig = &GenerationConfig{
-      ResponseMIMEType: "application/json",
-    }
-  }
+  gRequestBody.Tools, gRequestBody.ToolConfig = geminiTools(body)
 
-  // Make Google request
-  response, statusCode, err := GoogleResponseJSON(gRequestBody)
-  if err != nil {
-    return c.Status(statusCode).JSON(fiber.Map{
-      "error": err.Error(),
-    })
+  // Gemini can't combine function calling with a JSON response type
+  generationConfig := GenerationConfig{
+    Temperature: generation.Temperature,
+    TopP: generation.TopP,
+    MaxOutputTokens: generation.MaxTokens,
+    StopSequences: generation.Stop,
+    Seed: generation.Seed,
+    PresencePenalty: generation.PresencePenalty,
+    FrequencyPenalty: generation.FrequencyPenalty,
+  }
+  if (body.OutputJSON == nil || *body.OutputJSON) && len(body.Tools) == 0 {
+    generationConfig.ResponseMIMEType = "application/json"
+  }
+  if body.OutputSchema != nil {
+    generationConfig.ResponseMIMEType = "application/json"
+    generationConfig.ResponseSchema = geminiSchema(body.OutputSchema.Schema)
   }
+  if !reflect.DeepEqual(generationConfig, GenerationConfig{}) {
+    gRequestBody.GenerationConfig = &generationConfig
+  }
+
+  return gRequestBody, nil
+}
 
-  // If request is not successful, don't update the database
-  if statusCode != http.StatusOK {
-    return c.Status(statusCode).Send(response)
+func (googleProvider) Call(ctx context.Context, payload interface{}) ([]byte, int, error) {
+  return GoogleResponseJSON(ctx, payload.(GRequestBody))
+}
+
+type googleUsage struct {
+  PromptTokenCount int `json:"promptTokenCount"`
+  CandidatesTokenCount int `json:"candidatesTokenCount"`
+  CachedContentTokenCount int `json:"cachedContentTokenCount"`
+  TotalTokenCount int `json:"totalTokenCount"`
+}
+
+// Cached content is part of promptTokenCount but billed at the cached price
+func (usage googleUsage) tokenUsage() TokenUsage {
+  return TokenUsage{
+    InputTokens: usage.PromptTokenCount - usage.CachedContentTokenCount,
+    OutputTokens: usage.CandidatesTokenCount,
+    CachedInputTokens: usage.CachedContentTokenCount,
   }
+}
 
-  // Parse response to get token usage
+func (googleProvider) ParseUsage(response []byte) (TokenUsage, error) {
   var googleResponse struct {
-    UsageMetadata struct {
-      PromptTokenCount int `json:"promptTokenCount"`
-      CandidatesTokenCount int `json:"candidatesTokenCount"`
-      TotalTokenCount int `json:"totalTokenCount"`
-    } `json:"usageMetadata"`
+    UsageMetadata googleUsage `json:"usageMetadata"`
   }
   if err := json.Unmarshal(response, &googleResponse); err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error parsing response JSON",
-    })
+    return TokenUsage{}, err
   }
 
-  // Get model prices from models.json
-  inputPrice, outputPrice, err := getModelPrices(requestBody.Model, "google")
-  if err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error getting model prices",
-    })
+  return googleResponse.UsageMetadata.tokenUsage(), nil
+}
+
+func (googleProvider) Stream(ctx context.Context, payload interface{}) (*http.Response, error) {
+  return GoogleStream(ctx, payload.(GRequestBody))
+}
+
+// Every chunk carries the running usageMetadata, the last one wins
+func (googleProvider) ParseStreamUsage(data []byte, usage *TokenUsage) {
+  var chunk struct {
+    UsageMetadata *googleUsage `json:"usageMetadata"`
+  }
+  if err := json.Unmarshal(data, &chunk); err != nil || chunk.UsageMetadata == nil {
+    return
   }
 
-  // Calculate usage
-  inputTokens := googleResponse.UsageMetadata.PromptTokenCount
-  outputTokens := googleResponse.UsageMetadata.CandidatesTokenCount
-  inputUsage := float64(inputTokens) * (inputPrice / 1000000)
-  outputUsage := float64(outputTokens) * (outputPrice / 1000000)
+  *usage = chunk.UsageMetadata.tokenUsage()
+}
 
-  // Update MongoDB
-  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-  defer cancel()
+func (googleProvider) APIKeyEnv() string {
+  return "GEMINI_API_KEY"
+}
 
-  userID := requestBody.ID
-  filter := bson.M{"id_user": userID}
+// Gemini takes the key as a query parameter
+func (googleProvider) Authorize(req *http.Request, key string) {
+  query := req.URL.Query()
+  query.Set("key", key)
+  req.URL.RawQuery = query.Encode()
+}
 
-  // Check if the user exists
-  var user User
-  err = userCollection.FindOne(ctx, filter).Decode(&user)
-  if err != nil {
-    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-      "error": "User not found",
-    })
-  }
-
-  // Ensure the model name with dot notation is handled properly
-  modelKey := fmt.Sprintf("google.models.%s", strings.Replace(requestBody.Model, ".", "\u2024", -1))
-
-  update := bson.M{
-    "$inc": bson.M{
-      "input_usage": inputUsage,
-      "output_usage": outputUsage,
-      "google.input_usage": inputUsage,
-      "google.output_usage": outputUsage,
-      modelKey + ".input_tokens": inputTokens,
-      modelKey + ".output_tokens": outputTokens,
-      modelKey + ".input_usage": inputUsage,
-      modelKey + ".output_usage": outputUsage,
-    },
-    "$push": bson.M{
-      "history": History{
-        Company: "google",
-        Model: requestBody.Model,
-        InputTokens: inputTokens,
-        OutputTokens: outputTokens,
-        InputUsage: inputUsage,
-        OutputUsage: outputUsage,
-        Created: time.Now().Unix(),
-      },
-    },
-  }
-  opts := options.Update().SetUpsert(false)
-  _, err = userCollection.UpdateOne(ctx, filter, update, opts)
+// Listing models is free, so it is used to validate the key
+func (provider googleProvider) CheckAPIKey(key string) (int, error) {
+  req, err := http.NewRequest("GET", upstreamURL("google", "/v1beta/models?pageSize=1"), nil)
   if err != nil {
-    log.Printf("%v: ", err)
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error updating MongoDB",
-    })
+    return 0, err
   }
+  provider.Authorize(req, key)
 
-  // Return response
-  return c.Status(statusCode).Send(response)
+  return checkKeyRequest(req)
+}
+
+type googleCandidates struct {
+  Candidates []struct {
+    Content Content `json:"content"`
+    FinishReason string `json:"finishReason"`
+  } `json:"candidates"`
+  UsageMetadata googleUsage `json:"usageMetadata"`
+}
+
+// Text, tool calls and finish reason of the first candidate
+func (response googleCandidates) firstCandidate() (string, []ToolCall, string) {
+  if len(response.Candidates) == 0 {
+    return "", nil, ""
+  }
+
+  var text strings.Builder
+  for _, part := range response.Candidates[0].Content.Parts {
+    text.WriteString(part.Text)
+  }
+
+  finishReason := ""
+  switch response.Candidates[0].FinishReason {
+  case "":
+  case "STOP":
+    finishReason = "stop"
+  case "MAX_TOKENS":
+    finishReason = "length"
+  default:
+    finishReason = "content_filter"
+  }
+  return text.String(), geminiToolCalls(response.Candidates[0].Content.Parts), finishReason
+}
+
+func (googleProvider) TranslateResponse(response []byte) (ChatCompletion, error) {
+  var googleResponse googleCandidates
+  if err := json.Unmarshal(response, &googleResponse); err != nil {
+    return ChatCompletion{}, err
+  }
+
+  text, toolCalls, finishReason := googleResponse.firstCandidate()
+  return newChatCompletion(text, toolCalls, finishReason, ChatUsage{
+    PromptTokens: googleResponse.UsageMetadata.PromptTokenCount,
+    CompletionTokens: googleResponse.UsageMetadata.CandidatesTokenCount,
+  }), nil
+}
+
+func (googleProvider) StructuredOutput(response []byte) (string, error) {
+  var googleResponse googleCandidates
+  if err := json.Unmarshal(response, &googleResponse); err != nil || len(googleResponse.Candidates) == 0 {
+    return "", errors.New("the response has no output")
+  }
+
+  text, _, _ := googleResponse.firstCandidate()
+  return text, nil
+}
+
+// Gemini streams every function call whole, in a single chunk
+func (googleProvider) TranslateEvent(data []byte) (ChatDelta, string) {
+  var chunk googleCandidates
+  if err := json.Unmarshal(data, &chunk); err != nil {
+    return ChatDelta{}, ""
+  }
+  text, toolCalls, finishReason := chunk.firstCandidate()
+  return ChatDelta{Content: text, ToolCalls: toolCalls}, finishReason
 }
@@ -1,11 +1,35 @@
 package handlers
 
 import (
+  "context"
+  "log"
+  "time"
+
+  "go.mongodb.org/mongo-driver/bson"
   "go.mongodb.org/mongo-driver/mongo"
 )
 
 var userCollection *mongo.Collection
 
-func InitHandlers(collection *mongo.Collection) {
-  userCollection = collection
+// InitHandlers sets the collections used by the handlers. Usage events older
+// than retentionDays are expired by MongoDB, 0 keeps them forever.
+func InitHandlers(users *mongo.Collection, usageEvents *mongo.Collection, models *mongo.Collection, modelAudit *mongo.Collection, retentionDays int) {
+  userCollection = users
+  usageCollection = usageEvents
+  modelsCollection = models
+  modelAuditCollection = modelAudit
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  // API keys are looked up by hash on every request
+  _, err := userCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+    Keys: bson.D{{Key: "api_keys.hash", Value: 1}},
+  })
+  if err != nil {
+    log.Printf("Error creating api_keys index: %v", err)
+  }
+
+  ensureUsageIndexes(ctx, retentionDays)
+  ensureModelIndexes(ctx)
 }
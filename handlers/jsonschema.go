@@ -0,0 +1,407 @@
+package handlers
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "math"
+  "regexp"
+  "sort"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+// Stop listing problems after this many, the model only needs a few to fix
+// its answer
+const maxSchemaProblems = 10
+
+// schemaValidator checks documents against the JSON Schema keywords used by
+// structured outputs: type, enum, const, properties, required,
+// additionalProperties, items, the length, size and range limits, pattern,
+// allOf/anyOf/oneOf/not and local $ref. Other keywords such as format are
+// ignored.
+type schemaValidator struct {
+  root interface{}
+  problems []string
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+  decoder := json.NewDecoder(bytes.NewReader(data))
+  decoder.UseNumber()
+  var value interface{}
+  if err := decoder.Decode(&value); err != nil {
+    return nil, err
+  }
+  if decoder.More() {
+    return nil, fmt.Errorf("unexpected data after the JSON value")
+  }
+  return value, nil
+}
+
+// validateJSONSchema returns the problems of a document, none when it is valid
+func validateJSONSchema(schema json.RawMessage, document string) []string {
+  root, err := decodeJSON(schema)
+  if err != nil {
+    return []string{"the schema is not valid JSON"}
+  }
+  value, err := decodeJSON([]byte(document))
+  if err != nil {
+    return []string{"the output is not valid JSON: " + err.Error()}
+  }
+
+  validator := &schemaValidator{root: root}
+  validator.validate(root, value, "$", 0)
+  return validator.problems
+}
+
+func (v *schemaValidator) fail(path string, format string, args ...interface{}) {
+  if len(v.problems) < maxSchemaProblems {
+    v.problems = append(v.problems, path+" "+fmt.Sprintf(format, args...))
+  }
+}
+
+// valid reports whether a subschema matches without recording its problems
+func (v *schemaValidator) valid(schema interface{}, value interface{}, depth int) bool {
+  nested := &schemaValidator{root: v.root}
+  nested.validate(schema, value, "$", depth)
+  return len(nested.problems) == 0
+}
+
+func (v *schemaValidator) validate(schema interface{}, value interface{}, path string, depth int) {
+  // Recursive $refs would never end
+  if depth > 64 {
+    v.fail(path, "nests too deep")
+    return
+  }
+
+  switch typed := schema.(type) {
+  case bool:
+    if !typed {
+      v.fail(path, "is not allowed")
+    }
+    return
+  case map[string]interface{}:
+  default:
+    return
+  }
+  rules := schema.(map[string]interface{})
+
+  if ref, ok := rules["$ref"].(string); ok {
+    target, ok := v.resolve(ref)
+    if !ok {
+      v.fail(path, "uses unknown $ref %s", ref)
+      return
+    }
+    v.validate(target, value, path, depth+1)
+  }
+
+  if types, ok := rules["type"]; ok && !matchesType(types, value) {
+    v.fail(path, "must be of type %s, got %s", describeTypes(types), jsonType(value))
+    return
+  }
+
+  if options, ok := rules["enum"].([]interface{}); ok {
+    found := false
+    for _, option := range options {
+      if jsonEqual(option, value) {
+        found = true
+        break
+      }
+    }
+    if !found {
+      v.fail(path, "must be one of %s", compactJSON(options))
+    }
+  }
+  if constant, ok := rules["const"]; ok && !jsonEqual(constant, value) {
+    v.fail(path, "must be %s", compactJSON(constant))
+  }
+
+  for _, subschema := range schemaList(rules["allOf"]) {
+    v.validate(subschema, value, path, depth+1)
+  }
+  if subschemas := schemaList(rules["anyOf"]); len(subschemas) > 0 {
+    matched := false
+    for _, subschema := range subschemas {
+      if v.valid(subschema, value, depth+1) {
+        matched = true
+        break
+      }
+    }
+    if !matched {
+      v.fail(path, "must match at least one schema of anyOf")
+    }
+  }
+  if subschemas := schemaList(rules["oneOf"]); len(subschemas) > 0 {
+    matched := 0
+    for _, subschema := range subschemas {
+      if v.valid(subschema, value, depth+1) {
+        matched++
+      }
+    }
+    if matched != 1 {
+      v.fail(path, "must match exactly one schema of oneOf, matches %d", matched)
+    }
+  }
+  if not, ok := rules["not"]; ok && v.valid(not, value, depth+1) {
+    v.fail(path, "must not match the schema in not")
+  }
+
+  switch typed := value.(type) {
+  case map[string]interface{}:
+    v.validateObject(rules, typed, path, depth)
+  case []interface{}:
+    v.validateArray(rules, typed, path, depth)
+  case string:
+    v.validateString(rules, typed, path)
+  case json.Number:
+    number, _ := typed.Float64()
+    v.validateNumber(rules, number, path)
+  }
+}
+
+func (v *schemaValidator) validateObject(rules map[string]interface{}, object map[string]interface{}, path string, depth int) {
+  if required, ok := rules["required"].([]interface{}); ok {
+    for _, name := range required {
+      if name, ok := name.(string); ok {
+        if _, present := object[name]; !present {
+          v.fail(path, "is missing required property %q", name)
+        }
+      }
+    }
+  }
+  if limit, ok := schemaNumber(rules["minProperties"]); ok && float64(len(object)) < limit {
+    v.fail(path, "must have at least %g properties", limit)
+  }
+  if limit, ok := schemaNumber(rules["maxProperties"]); ok && float64(len(object)) > limit {
+    v.fail(path, "must have at most %g properties", limit)
+  }
+
+  properties, _ := rules["properties"].(map[string]interface{})
+  additional, hasAdditional := rules["additionalProperties"]
+  for _, name := range sortedKeys(object) {
+    propertyPath := path + "." + name
+    if property, ok := properties[name]; ok {
+      v.validate(property, object[name], propertyPath, depth+1)
+      continue
+    }
+    if !hasAdditional {
+      continue
+    }
+    if allowed, ok := additional.(bool); ok {
+      if !allowed {
+        v.fail(path, "must not have property %q", name)
+      }
+      continue
+    }
+    v.validate(additional, object[name], propertyPath, depth+1)
+  }
+}
+
+func (v *schemaValidator) validateArray(rules map[string]interface{}, array []interface{}, path string, depth int) {
+  if limit, ok := schemaNumber(rules["minItems"]); ok && float64(len(array)) < limit {
+    v.fail(path, "must have at least %g items", limit)
+  }
+  if limit, ok := schemaNumber(rules["maxItems"]); ok && float64(len(array)) > limit {
+    v.fail(path, "must have at most %g items", limit)
+  }
+  if unique, _ := rules["uniqueItems"].(bool); unique {
+    for i := range array {
+      for j := i + 1; j < len(array); j++ {
+        if jsonEqual(array[i], array[j]) {
+          v.fail(path, "must not repeat items, %d and %d are equal", i, j)
+        }
+      }
+    }
+  }
+  if items, ok := rules["items"]; ok {
+    for i, item := range array {
+      v.validate(items, item, path+"["+strconv.Itoa(i)+"]", depth+1)
+    }
+  }
+}
+
+func (v *schemaValidator) validateString(rules map[string]interface{}, text string, path string) {
+  length := float64(utf8.RuneCountInString(text))
+  if limit, ok := schemaNumber(rules["minLength"]); ok && length < limit {
+    v.fail(path, "must be at least %g characters long", limit)
+  }
+  if limit, ok := schemaNumber(rules["maxLength"]); ok && length > limit {
+    v.fail(path, "must be at most %g characters long", limit)
+  }
+  // Patterns Go can't compile, such as lookarounds, are not checked
+  if pattern, ok := rules["pattern"].(string); ok {
+    if expression, err := regexp.Compile(pattern); err == nil && !expression.MatchString(text) {
+      v.fail(path, "must match the pattern %s", pattern)
+    }
+  }
+}
+
+func (v *schemaValidator) validateNumber(rules map[string]interface{}, number float64, path string) {
+  if limit, ok := schemaNumber(rules["minimum"]); ok && number < limit {
+    v.fail(path, "must be at least %g", limit)
+  }
+  if limit, ok := schemaNumber(rules["maximum"]); ok && number > limit {
+    v.fail(path, "must be at most %g", limit)
+  }
+  if limit, ok := schemaNumber(rules["exclusiveMinimum"]); ok && number <= limit {
+    v.fail(path, "must be greater than %g", limit)
+  }
+  if limit, ok := schemaNumber(rules["exclusiveMaximum"]); ok && number >= limit {
+    v.fail(path, "must be less than %g", limit)
+  }
+  if divisor, ok := schemaNumber(rules["multipleOf"]); ok && divisor > 0 {
+    quotient := number / divisor
+    if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+      v.fail(path, "must be a multiple of %g", divisor)
+    }
+  }
+}
+
+// resolve follows a $ref within the schema, e.g. #/$defs/address
+func (v *schemaValidator) resolve(ref string) (interface{}, bool) {
+  if ref == "#" {
+    return v.root, true
+  }
+  if !strings.HasPrefix(ref, "#/") {
+    return nil, false
+  }
+
+  current := v.root
+  for _, token := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+    token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+    switch node := current.(type) {
+    case map[string]interface{}:
+      next, ok := node[token]
+      if !ok {
+        return nil, false
+      }
+      current = next
+    case []interface{}:
+      index, err := strconv.Atoi(token)
+      if err != nil || index < 0 || index >= len(node) {
+        return nil, false
+      }
+      current = node[index]
+    default:
+      return nil, false
+    }
+  }
+  return current, true
+}
+
+func schemaList(value interface{}) []interface{} {
+  list, _ := value.([]interface{})
+  return list
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+  number, ok := value.(json.Number)
+  if !ok {
+    return 0, false
+  }
+  parsed, err := number.Float64()
+  return parsed, err == nil
+}
+
+func jsonType(value interface{}) string {
+  switch typed := value.(type) {
+  case nil:
+    return "null"
+  case bool:
+    return "boolean"
+  case string:
+    return "string"
+  case json.Number:
+    if _, err := typed.Int64(); err == nil {
+      return "integer"
+    }
+    return "number"
+  case []interface{}:
+    return "array"
+  default:
+    return "object"
+  }
+}
+
+func matchesType(types interface{}, value interface{}) bool {
+  actual := jsonType(value)
+  var allowed []interface{}
+  switch typed := types.(type) {
+  case string:
+    allowed = []interface{}{typed}
+  case []interface{}:
+    allowed = typed
+  default:
+    return true
+  }
+
+  for _, name := range allowed {
+    if name == actual || name == "number" && actual == "integer" {
+      return true
+    }
+    // 1.0 is an integer too
+    if name == "integer" && actual == "number" {
+      number, _ := value.(json.Number).Float64()
+      if number == math.Trunc(number) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func describeTypes(types interface{}) string {
+  if list, ok := types.([]interface{}); ok {
+    names := make([]string, len(list))
+    for i, name := range list {
+      names[i] = fmt.Sprint(name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, " or ")
+  }
+  return fmt.Sprint(types)
+}
+
+// jsonEqual compares decoded values, numbers by value
+func jsonEqual(a interface{}, b interface{}) bool {
+  switch typed := a.(type) {
+  case json.Number:
+    other, ok := b.(json.Number)
+    if !ok {
+      return false
+    }
+    x, _ := typed.Float64()
+    y, _ := other.Float64()
+    return x == y
+  case []interface{}:
+    other, ok := b.([]interface{})
+    if !ok || len(typed) != len(other) {
+      return false
+    }
+    for i := range typed {
+      if !jsonEqual(typed[i], other[i]) {
+        return false
+      }
+    }
+    return true
+  case map[string]interface{}:
+    other, ok := b.(map[string]interface{})
+    if !ok || len(typed) != len(other) {
+      return false
+    }
+    for key, value := range typed {
+      if otherValue, ok := other[key]; !ok || !jsonEqual(value, otherValue) {
+        return false
+      }
+    }
+    return true
+  default:
+    return a == b
+  }
+}
+
+func compactJSON(value interface{}) string {
+  encoded, _ := json.Marshal(value)
+  return string(encoded)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+  "encoding/json"
+  "strings"
+  "testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+  tests := []struct {
+    name string
+    schema string
+    document string
+    // problems are substrings of the expected problems, in order
+    problems []string
+  }{
+    // $ref resolution
+    {"ref to defs", `{"$defs": {"zip": {"type": "string", "pattern": "^[0-9]{5}$"}}, "type": "object", "properties": {"zip": {"$ref": "#/$defs/zip"}}}`, `{"zip": "12345"}`, nil},
+    {"ref to defs fails", `{"$defs": {"zip": {"type": "string", "pattern": "^[0-9]{5}$"}}, "type": "object", "properties": {"zip": {"$ref": "#/$defs/zip"}}}`, `{"zip": "1234"}`, []string{"$.zip must match the pattern"}},
+    {"ref to definitions", `{"definitions": {"n": {"type": "integer"}}, "type": "array", "items": {"$ref": "#/definitions/n"}}`, `[1, "two"]`, []string{"$[1] must be of type integer, got string"}},
+    {"ref with escaped pointer", `{"$defs": {"a/b": {"type": "boolean"}}, "$ref": "#/$defs/a~1b"}`, `1`, []string{"$ must be of type boolean"}},
+    {"recursive ref to root", `{"type": "object", "properties": {"child": {"$ref": "#"}}, "additionalProperties": false}`, `{"child": {"child": {"other": 1}}}`, []string{`$.child.child must not have property "other"`}},
+    {"unknown ref", `{"$ref": "#/$defs/missing"}`, `{}`, []string{"uses unknown $ref #/$defs/missing"}},
+    {"remote ref", `{"$ref": "https://example.com/schema.json"}`, `{}`, []string{"uses unknown $ref"}},
+
+    // oneOf and anyOf
+    {"anyOf matches one", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `3`, nil},
+    {"anyOf matches none", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`, []string{"must match at least one schema of anyOf"}},
+    {"oneOf matches one", `{"oneOf": [{"type": "string"}, {"type": "integer"}]}`, `"a"`, nil},
+    {"oneOf matches two", `{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `3`, []string{"must match exactly one schema of oneOf, matches 2"}},
+    {"oneOf matches none", `{"oneOf": [{"type": "string"}, {"type": "integer"}]}`, `null`, []string{"matches 0"}},
+    {"anyOf problems stay inside", `{"anyOf": [{"type": "object", "required": ["a"]}, {"type": "object", "required": ["b"]}]}`, `{"b": 1}`, nil},
+
+    // integer and number
+    {"integer", `{"type": "integer"}`, `3`, nil},
+    {"integer written as 1.0", `{"type": "integer"}`, `1.0`, nil},
+    {"integer in exponent form", `{"type": "integer"}`, `1e2`, nil},
+    {"fraction is not an integer", `{"type": "integer"}`, `1.5`, []string{"must be of type integer, got number"}},
+    {"integer is a number", `{"type": "number"}`, `3`, nil},
+    {"string is not a number", `{"type": "number"}`, `"3"`, []string{"must be of type number, got string"}},
+    {"type list", `{"type": ["integer", "null"]}`, `null`, nil},
+    {"type list fails", `{"type": ["integer", "null"]}`, `"x"`, []string{"must be of type integer or null, got string"}},
+    {"enum compares numbers by value", `{"enum": [1, 2]}`, `2.0`, nil},
+
+    // additionalProperties
+    {"additionalProperties false", `{"type": "object", "properties": {"a": {"type": "string"}}, "additionalProperties": false}`, `{"a": "x"}`, nil},
+    {"additionalProperties false fails", `{"type": "object", "properties": {"a": {"type": "string"}}, "additionalProperties": false}`, `{"a": "x", "c": 1, "b": 2}`, []string{`$ must not have property "b"`, `$ must not have property "c"`}},
+    {"additionalProperties schema", `{"type": "object", "additionalProperties": {"type": "integer"}}`, `{"a": 1, "b": "2"}`, []string{"$.b must be of type integer"}},
+    {"additionalProperties unset", `{"type": "object", "properties": {"a": {}}}`, `{"b": 1}`, nil},
+    {"required", `{"type": "object", "required": ["a", "b"]}`, `{"a": 1}`, []string{`$ is missing required property "b"`}},
+
+    // uniqueItems
+    {"uniqueItems", `{"type": "array", "uniqueItems": true}`, `[1, "1", [1], {"a": 1}]`, nil},
+    {"uniqueItems repeats numbers by value", `{"type": "array", "uniqueItems": true}`, `[1, 2, 1.0]`, []string{"$ must not repeat items, 0 and 2 are equal"}},
+    {"uniqueItems repeats objects", `{"type": "array", "uniqueItems": true}`, `[{"a": 1, "b": [2]}, {"b": [2], "a": 1}]`, []string{"0 and 1 are equal"}},
+    {"uniqueItems false", `{"type": "array", "uniqueItems": false}`, `[1, 1]`, nil},
+
+    // documents
+    {"invalid JSON", `{"type": "object"}`, `{"a": `, []string{"the output is not valid JSON"}},
+    {"trailing data", `{"type": "object"}`, `{} {}`, []string{"the output is not valid JSON"}},
+    {"false schema", `{"type": "object", "properties": {"a": false}}`, `{"a": 1}`, []string{"$.a is not allowed"}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      problems := validateJSONSchema(json.RawMessage(test.schema), test.document)
+      if len(problems) != len(test.problems) {
+        t.Fatalf("got problems %q, want %q", problems, test.problems)
+      }
+      for i, want := range test.problems {
+        if !strings.Contains(problems[i], want) {
+          t.Errorf("problem %d is %q, want it to contain %q", i, problems[i], want)
+        }
+      }
+    })
+  }
+}
+
+func TestValidateJSONSchemaStopsRecursion(t *testing.T) {
+  problems := validateJSONSchema(json.RawMessage(`{"$ref": "#"}`), `{}`)
+  if len(problems) == 0 || !strings.Contains(problems[0], "nests too deep") {
+    t.Errorf("got problems %q", problems)
+  }
+}
+
+func TestValidateJSONSchemaLimitsProblems(t *testing.T) {
+  problems := validateJSONSchema(json.RawMessage(`{"type": "array", "items": {"type": "string"}}`), `[1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12]`)
+  if len(problems) != maxSchemaProblems {
+    t.Errorf("got %d problems, want %d", len(problems), maxSchemaProblems)
+  }
+}
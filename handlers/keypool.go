@@ -0,0 +1,251 @@
+package handlers
+
+import (
+  "context"
+  "log"
+  "net/http"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+// How long a key is taken out of rotation after the provider rejects it
+const (
+  keyRateLimitCooldown = 30 * time.Second
+  keyUnauthorizedCooldown = 10 * time.Minute
+)
+
+// KeyedProvider is implemented by providers authenticated with API keys
+type KeyedProvider interface {
+  // APIKeyEnv is the environment variable holding the key, the same name
+  // with an S suffix holds a comma separated pool of label=key entries
+  APIKeyEnv() string
+  // Authorize adds the key to an upstream request
+  Authorize(req *http.Request, key string)
+  // CheckAPIKey makes a cheap upstream call and returns its status code
+  CheckAPIKey(key string) (int, error)
+}
+
+type poolKey struct {
+  Label string
+  Secret string
+  inFlight int
+  coolUntil time.Time
+  requests int64
+  failures int64
+}
+
+type KeyStatus struct {
+  Label string `json:"label"`
+  MaskedKey string `json:"masked_key"`
+  InFlight int `json:"in_flight"`
+  Requests int64 `json:"requests"`
+  Failures int64 `json:"failures"`
+  CoolingUntil int64 `json:"cooling_until,omitempty"`
+}
+
+// keyPool hands out a provider's keys round-robin or to the least loaded one,
+// skipping keys that are cooling down after a 429 or 401
+type keyPool struct {
+  mu sync.Mutex
+  keys []*poolKey
+  next int
+  leastLoaded bool
+}
+
+// Pools live in memory, the server runs as one process so a key cooled down
+// by one request is skipped by all of them and the counters cover every call
+var (
+  keyPoolsMu sync.Mutex
+  keyPools = map[string]*keyPool{}
+)
+
+// getKeyPool loads the company's keys from the environment on first use, e.g.
+// OPENAI_API_KEYS=team-a=sk-...,team-b=sk-... and/or OPENAI_API_KEY=sk-...
+// KEY_POOL_STRATEGY picks round_robin (default) or least_loaded.
+func getKeyPool(company string) *keyPool {
+  keyPoolsMu.Lock()
+  defer keyPoolsMu.Unlock()
+
+  if pool, ok := keyPools[company]; ok {
+    return pool
+  }
+
+  pool := &keyPool{leastLoaded: os.Getenv("KEY_POOL_STRATEGY") == "least_loaded"}
+  keyPools[company] = pool
+
+  provider, ok := getProvider(company)
+  if !ok {
+    return pool
+  }
+  keyed, ok := provider.(KeyedProvider)
+  if !ok {
+    return pool
+  }
+
+  seen := map[string]bool{}
+  add := func(label string, secret string) {
+    if secret == "" || seen[secret] {
+      return
+    }
+    seen[secret] = true
+    if label == "" {
+      label = maskKey(secret)
+    }
+    pool.keys = append(pool.keys, &poolKey{Label: label, Secret: secret})
+  }
+
+  for _, entry := range strings.Split(os.Getenv(keyed.APIKeyEnv()+"S"), ",") {
+    entry = strings.TrimSpace(entry)
+    label, secret, found := strings.Cut(entry, "=")
+    if !found {
+      label, secret = "", entry
+    }
+    add(strings.TrimSpace(label), strings.TrimSpace(secret))
+  }
+  add("default", os.Getenv(keyed.APIKeyEnv()))
+
+  return pool
+}
+
+func (pool *keyPool) configured() bool {
+  pool.mu.Lock()
+  defer pool.mu.Unlock()
+  return len(pool.keys) > 0
+}
+
+// available reports whether any key is out of its cooldown
+func (pool *keyPool) available() bool {
+  pool.mu.Lock()
+  defer pool.mu.Unlock()
+
+  now := time.Now()
+  for _, key := range pool.keys {
+    if !key.coolUntil.After(now) {
+      return true
+    }
+  }
+  return false
+}
+
+// acquire picks a key that isn't cooling down, or the one that recovers
+// first when all of them are. The caller must release it.
+func (pool *keyPool) acquire() *poolKey {
+  pool.mu.Lock()
+  defer pool.mu.Unlock()
+
+  if len(pool.keys) == 0 {
+    return nil
+  }
+
+  now := time.Now()
+  var chosen *poolKey
+  chosenIndex := 0
+  for offset := range pool.keys {
+    index := (pool.next + offset) % len(pool.keys)
+    key := pool.keys[index]
+    if key.coolUntil.After(now) {
+      continue
+    }
+    if chosen == nil || pool.leastLoaded && key.inFlight < chosen.inFlight {
+      chosen, chosenIndex = key, index
+    }
+    if !pool.leastLoaded {
+      break
+    }
+  }
+
+  if chosen == nil {
+    for index, key := range pool.keys {
+      if chosen == nil || key.coolUntil.Before(chosen.coolUntil) {
+        chosen, chosenIndex = key, index
+      }
+    }
+  }
+
+  pool.next = (chosenIndex + 1) % len(pool.keys)
+  chosen.inFlight++
+  chosen.requests++
+  return chosen
+}
+
+// release returns the key and cools it down if the provider rejected it
+func (pool *keyPool) release(key *poolKey, statusCode int, retryAfter time.Duration) {
+  if key == nil {
+    return
+  }
+
+  pool.mu.Lock()
+  defer pool.mu.Unlock()
+
+  key.inFlight--
+  switch statusCode {
+  case http.StatusTooManyRequests:
+    key.failures++
+    key.coolUntil = time.Now().Add(max(retryAfter, keyRateLimitCooldown))
+  case http.StatusUnauthorized, http.StatusForbidden:
+    key.failures++
+    key.coolUntil = time.Now().Add(keyUnauthorizedCooldown)
+    log.Printf("Key %s was rejected with %d, taking it out of rotation", key.Label, statusCode)
+  }
+}
+
+func (pool *keyPool) statuses() []KeyStatus {
+  pool.mu.Lock()
+  defer pool.mu.Unlock()
+
+  statuses := make([]KeyStatus, 0, len(pool.keys))
+  for _, key := range pool.keys {
+    status := KeyStatus{
+      Label: key.Label,
+      MaskedKey: maskKey(key.Secret),
+      InFlight: key.inFlight,
+      Requests: key.requests,
+      Failures: key.failures,
+    }
+    if key.coolUntil.After(time.Now()) {
+      status.CoolingUntil = key.coolUntil.Unix()
+    }
+    statuses = append(statuses, status)
+  }
+  return statuses
+}
+
+func (pool *keyPool) secrets() []*poolKey {
+  pool.mu.Lock()
+  defer pool.mu.Unlock()
+  return append([]*poolKey(nil), pool.keys...)
+}
+
+// keyTracker records which pooled key served a request, so its cost can be
+// attributed to the key's billing account
+type keyTracker struct {
+  mu sync.Mutex
+  label string
+}
+
+type keyTrackerContextKey struct{}
+
+func withKeyTracker(ctx context.Context) (context.Context, *keyTracker) {
+  tracker := &keyTracker{}
+  return context.WithValue(ctx, keyTrackerContextKey{}, tracker), tracker
+}
+
+func (tracker *keyTracker) set(label string) {
+  tracker.mu.Lock()
+  defer tracker.mu.Unlock()
+  tracker.label = label
+}
+
+func (tracker *keyTracker) Label() string {
+  tracker.mu.Lock()
+  defer tracker.mu.Unlock()
+  return tracker.label
+}
+
+func trackKey(ctx context.Context, label string) {
+  if tracker, ok := ctx.Value(keyTrackerContextKey{}).(*keyTracker); ok {
+    tracker.set(label)
+  }
+}
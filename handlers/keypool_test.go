@@ -0,0 +1,35 @@
+package handlers
+
+import (
+  "context"
+  "net/http"
+  "testing"
+)
+
+func TestRateLimitedKeyIsSkippedByLaterRequests(t *testing.T) {
+  s := newStandIn(t, testUpstreamConfig, answer(http.StatusTooManyRequests, nil), answer(http.StatusOK, nil))
+  t.Setenv("OPENAI_API_KEY", "")
+  t.Setenv("OPENAI_API_KEYS", "first=sk-first,second=sk-second")
+  resetKeyPool("openai")
+
+  for i := 0; i < 3; i++ {
+    if _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody()); err != nil || statusCode != http.StatusOK {
+      t.Fatalf("request %d: got status %d, error %v", i, statusCode, err)
+    }
+  }
+
+  want := []string{"Bearer sk-first", "Bearer sk-second", "Bearer sk-second", "Bearer sk-second"}
+  if len(s.auth) != len(want) {
+    t.Fatalf("upstream got %d requests, want %d", len(s.auth), len(want))
+  }
+  for i := range want {
+    if s.auth[i] != want[i] {
+      t.Errorf("request %d used %q, want %q", i, s.auth[i], want[i])
+    }
+  }
+
+  statuses := getKeyPool("openai").statuses()
+  if statuses[0].Failures != 1 || statuses[0].CoolingUntil == 0 || statuses[1].Requests != 3 {
+    t.Errorf("unexpected key statuses %+v", statuses)
+  }
+}
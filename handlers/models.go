@@ -1,44 +1,69 @@
 package handlers
 
 import (
-  "errors"
-  "os"
   "encoding/json"
+  "errors"
   "fmt"
   "log"
+  "strings"
+  "time"
 )
 
 type User struct {
-  ID string `json:"id_user"`
-  InputUsage float64 `json:"input_usage"`
-  OutputUsage float64 `json:"output_usage"`
-  History []History `json:"history"`
-  OpenAIUsage Usage `json:"openai"`
-  GoogleUsage Usage `json:"google"`
-  AnthropicUsage Usage `json:"anthropic"`
+  ID string `json:"id_user" bson:"id_user"`
+  InputUsage float64 `json:"input_usage" bson:"input_usage"`
+  OutputUsage float64 `json:"output_usage" bson:"output_usage"`
+  OpenAIUsage Usage `json:"openai" bson:"openai"`
+  GoogleUsage Usage `json:"google" bson:"google"`
+  AnthropicUsage Usage `json:"anthropic" bson:"anthropic"`
+  MonthlyUsage map[string]MonthlyUsage `json:"monthly_usage" bson:"monthly_usage"`
+  Budget *Budget `json:"budget,omitempty" bson:"budget,omitempty"`
+  APIKeys []APIKey `json:"api_keys" bson:"api_keys"`
 }
 
 type Usage struct {
-  InputUsage float64 `json:"input_usage"`
-  OutputUsage float64 `json:"output_usage"`
-  Models map[string]ModelUsage `json:"models"`
+  InputUsage float64 `json:"input_usage" bson:"input_usage"`
+  OutputUsage float64 `json:"output_usage" bson:"output_usage"`
+  Models map[string]ModelUsage `json:"models" bson:"models"`
 }
 
 type ModelUsage struct {
-  InputTokens int `json:"input_tokens"`
-  OutputTokens int `json:"output_tokens"`
-  InputUsage float64 `json:"input_usage"`
-  OutputUsage float64 `json:"output_usage"`
+  InputTokens int `json:"input_tokens" bson:"input_tokens"`
+  OutputTokens int `json:"output_tokens" bson:"output_tokens"`
+  CachedInputTokens int `json:"cached_input_tokens,omitempty" bson:"cached_input_tokens,omitempty"`
+  CacheWriteTokens int `json:"cache_write_tokens,omitempty" bson:"cache_write_tokens,omitempty"`
+  AudioSeconds float64 `json:"audio_seconds,omitempty" bson:"audio_seconds,omitempty"`
+  InputUsage float64 `json:"input_usage" bson:"input_usage"`
+  OutputUsage float64 `json:"output_usage" bson:"output_usage"`
+}
+
+// Spend for one calendar month, keyed by YYYY-MM in the user document
+type MonthlyUsage struct {
+  Total float64 `json:"total" bson:"total"`
+  Companies map[string]float64 `json:"companies" bson:"companies"`
+  Models map[string]float64 `json:"models" bson:"models"`
 }
 
+// History is a single billed call, stored in the usage_events collection
 type History struct {
-  Company string `json:"company"`
-  Model string `json:"model"`
-  InputTokens int `json:"input_tokens"`
-  OutputTokens int `json:"output_tokens"`
-  InputUsage float64 `json:"input_usage"`
-  OutputUsage float64 `json:"output_usage"`
-  Created int64 `json:"created"`
+  UserID string `json:"id_user" bson:"id_user"`
+  Company string `json:"company" bson:"company"`
+  Model string `json:"model" bson:"model"`
+  InputTokens int `json:"input_tokens" bson:"input_tokens"`
+  OutputTokens int `json:"output_tokens" bson:"output_tokens"`
+  // InputTokens excludes the prompt tokens read from or written to the cache
+  CachedInputTokens int `json:"cached_input_tokens,omitempty" bson:"cached_input_tokens,omitempty"`
+  CacheWriteTokens int `json:"cache_write_tokens,omitempty" bson:"cache_write_tokens,omitempty"`
+  AudioSeconds float64 `json:"audio_seconds,omitempty" bson:"audio_seconds,omitempty"`
+  InputUsage float64 `json:"input_usage" bson:"input_usage"`
+  OutputUsage float64 `json:"output_usage" bson:"output_usage"`
+  Created int64 `json:"created" bson:"created"`
+  // PriceVersion identifies the catalog price the call was billed at
+  PriceVersion string `json:"price_version,omitempty" bson:"price_version,omitempty"`
+  // APIKey is the label of the pooled provider key that served the call
+  APIKey string `json:"api_key,omitempty" bson:"api_key,omitempty"`
+  // Timestamp mirrors Created as a date so the retention TTL index can use it
+  Timestamp time.Time `json:"-" bson:"timestamp"`
 }
 
 // Structures and common functions
@@ -50,17 +75,43 @@ type RequestBody struct {
   Prompt *string `json:"prompt,omitempty"`
   Messages []Message `json:"messages,omitempty"`
   OutputJSON *bool `json:"output_JSON"`
+  // OutputSchema asks for JSON matching a schema, it is validated and repaired
+  OutputSchema *OutputSchema `json:"output_schema,omitempty"`
+  Stream *bool `json:"stream,omitempty"`
+  // Temperature is kept for older clients, generation.temperature wins
+  Temperature *float64 `json:"temperature,omitempty"`
+  // Generation is mapped to each provider's sampling parameters
+  Generation *Generation `json:"generation,omitempty"`
+  // Tools use OpenAI's schema and are translated for the other providers
+  Tools []Tool `json:"tools,omitempty"`
+  ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+  // Fallback overrides the chain in fallbacks.json, an empty list disables it
+  Fallback *[]string `json:"fallback,omitempty"`
 }
 
 type Message struct {
   Role string `json:"role"`
-  Content string `json:"content"`
+  Content MessageContent `json:"content"`
+  // ToolCalls are the calls requested by an assistant message
+  ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+  // ToolCallID is the call a tool message answers
+  ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 func processRequest(body RequestBody) ([]OAIMessage, []Content, error) {
   var openAIMessages []OAIMessage
   var googleContents []Content
 
+  if err := validateTools(body); err != nil {
+    return nil, nil, err
+  }
+  if err := validateContent(body); err != nil {
+    return nil, nil, err
+  }
+  if err := validateOutputSchema(body); err != nil {
+    return nil, nil, err
+  }
+
   if len(body.Messages) == 0 {
     systemPrompt := "You are a helpful assistant."
     if body.SystemPrompt != nil {
@@ -75,84 +126,191 @@ func processRequest(body RequestBody) ([]OAIMessage, []Content, error) {
       return nil, nil, errors.New("prompt is required if messages are not provided")
     }
 
-    openAIMessages = append(openAIMessages, OAIMessage{Role: "system", Content: systemPrompt})
-    openAIMessages = append(openAIMessages, OAIMessage{Role: "user", Content: *body.Prompt})
+    openAIMessages = append(openAIMessages, OAIMessage{Role: "system", Content: TextContent(systemPrompt)})
+    openAIMessages = append(openAIMessages, OAIMessage{Role: "user", Content: TextContent(*body.Prompt)})
 
     googleContents = append(googleContents, Content{Role: "user", Parts: []Part{{Text: systemPrompt}}})
     googleContents = append(googleContents, Content{Role: "user", Parts: []Part{{Text: *body.Prompt}}})
   } else {
     if body.OutputJSON == nil || *body.OutputJSON {
-      openAIMessages = append(openAIMessages, OAIMessage{Role: "system", Content: "Response Format: JSON"})
+      openAIMessages = append(openAIMessages, OAIMessage{Role: "system", Content: TextContent("Response Format: JSON")})
       googleContents = append(googleContents, Content{Role: "user", Parts: []Part{{Text: "Response Format: JSON"}}})
     }
 
-    for _, msg := range body.Messages {
-      openAIMessages = append(openAIMessages, OAIMessage{Role: msg.Role, Content: msg.Content})
+    callNames := toolCallNames(body.Messages)
+    for i, msg := range body.Messages {
+      openAIMessages = append(openAIMessages, OAIMessage{Role: msg.Role, Content: msg.Content, ToolCalls: msg.ToolCalls, ToolCallID: msg.ToolCallID})
+
+      // Answers to parallel calls go back to Gemini in a single turn
+      parts := geminiParts(msg, callNames)
+      if msg.Role == "tool" && i > 0 && body.Messages[i-1].Role == "tool" {
+        last := &googleContents[len(googleContents)-1]
+        last.Parts = append(last.Parts, parts...)
+        continue
+      }
 
       googleRole := "user"
       if msg.Role == "assistant" {
         googleRole = "model"
       }
-      googleContents = append(googleContents, Content{Role: googleRole, Parts: []Part{{Text: msg.Content}}})
+      googleContents = append(googleContents, Content{Role: googleRole, Parts: parts})
     }
   }
 
   return openAIMessages, googleContents, nil
 }
 
-// Helper function to load model prices from models.json
-func getModelPrices(model string, company string) (float64, float64, error) {
-  var modelsData map[string]interface{}
-  modelsFile, err := os.ReadFile("services/models.json")
-  if err != nil {
-    log.Printf("Error reading models.json: %v", err)
-    return 0, 0, err
+// Anthropic takes the system prompt as a top-level field instead of a message
+func processAnthropicRequest(body RequestBody) (string, []ANTMessage, error) {
+  var system string
+  var anthropicMessages []ANTMessage
+
+  if err := validateTools(body); err != nil {
+    return "", nil, err
+  }
+  if err := validateContent(body); err != nil {
+    return "", nil, err
   }
-  err = json.Unmarshal(modelsFile, &modelsData)
-  if err != nil {
-    log.Printf("Error unmarshalling models.json: %v", err)
-    return 0, 0, err
+  if err := validateOutputSchema(body); err != nil {
+    return "", nil, err
   }
 
-  companyModels, companyExists := modelsData[company].(map[string]interface{})["models"].(map[string]interface{})
-  if !companyExists {
-    log.Printf("Company %s not found in models.json", company)
-    return 0, 0, fmt.Errorf("company not found")
+  if len(body.Messages) == 0 {
+    system = "You are a helpful assistant."
+    if body.SystemPrompt != nil {
+      system = *body.SystemPrompt
+    }
+
+    if body.OutputJSON == nil || *body.OutputJSON {
+      system += "\nResponse Format: JSON"
+    }
+
+    if body.Prompt == nil {
+      return "", nil, errors.New("prompt is required if messages are not provided")
+    }
+
+    anthropicMessages = append(anthropicMessages, ANTMessage{Role: "user", Content: []ANTBlock{{Type: "text", Text: *body.Prompt}}})
+  } else {
+    var systemParts []string
+    for _, msg := range body.Messages {
+      if msg.Role == "system" {
+        systemParts = append(systemParts, msg.Content.Text())
+        continue
+      }
+
+      // Tool results are sent by the user, next to any other user content
+      role := msg.Role
+      if role == "tool" {
+        role = "user"
+      }
+      if len(anthropicMessages) > 0 && anthropicMessages[len(anthropicMessages)-1].Role == role {
+        last := &anthropicMessages[len(anthropicMessages)-1]
+        last.Content = append(last.Content, anthropicBlocks(msg)...)
+        continue
+      }
+      anthropicMessages = append(anthropicMessages, ANTMessage{Role: role, Content: anthropicBlocks(msg)})
+    }
+
+    if body.OutputJSON == nil || *body.OutputJSON {
+      systemParts = append(systemParts, "Response Format: JSON")
+    }
+    system = strings.Join(systemParts, "\n")
+
+    if len(anthropicMessages) == 0 {
+      return "", nil, errors.New("at least one user message is required")
+    }
   }
 
-  modelData, modelExists := companyModels[model].(map[string]interface{})
-  if !modelExists {
+  return system, anthropicMessages, nil
+}
+
+// Helper function to look up a model's current token prices in the catalog
+func getModelPrices(model string, company string) (ModelPrice, error) {
+  spec, exists := currentCatalog().Model(company, model)
+  if !exists {
     log.Printf("Model %s not found in company %s", model, company)
-    return 0, 0, fmt.Errorf("model not found")
+    return ModelPrice{}, fmt.Errorf("model not found")
   }
-  
-  pricePerTokens := modelData["price_per_1million_tokens"].(map[string]interface{})
 
-  inputPrice := pricePerTokens["input"].(float64)
-  outputPrice := pricePerTokens["output"].(float64)
+  if spec.PricePerTokens == nil || !spec.HasCapability("chat") {
+    log.Printf("Model %s of company %s is not a chat model", model, company)
+    return ModelPrice{}, fmt.Errorf("chat model not found")
+  }
 
-  return inputPrice, outputPrice, nil
+  return spec.PriceAt(time.Now()), nil
+}
+
+// Helper function to find which company serves a model in the catalog
+func findModelCompany(model string) (string, error) {
+  company, exists := currentCatalog().FindCompany(model)
+  if !exists {
+    return "", fmt.Errorf("model %s not found", model)
+  }
+  return company, nil
 }
 
 // openai-specific structures
 type OAIMessage struct {
   Role string `json:"role"`
-  Content string `json:"content"`
+  Content MessageContent `json:"content"`
+  ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+  ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 type OAIRequestBody struct {
   Model string `json:"model"`
   Messages []OAIMessage `json:"messages"`
   ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+  Temperature *float64 `json:"temperature,omitempty"`
+  TopP *float64 `json:"top_p,omitempty"`
+  MaxTokens *int `json:"max_tokens,omitempty"`
+  Stop []string `json:"stop,omitempty"`
+  Seed *int64 `json:"seed,omitempty"`
+  PresencePenalty *float64 `json:"presence_penalty,omitempty"`
+  FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+  Tools []Tool `json:"tools,omitempty"`
+  ToolChoice *ToolChoice `json:"tool_choice,omitempty"`
+  Stream bool `json:"stream,omitempty"`
+  StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+  IncludeUsage bool `json:"include_usage"`
 }
 
 type ResponseFormat struct {
   Type string `json:"type"`
+  JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+  Name string `json:"name"`
+  Schema json.RawMessage `json:"schema"`
+  Strict bool `json:"strict,omitempty"`
 }
 
 // google-specific structures
 type Part struct {
-  Text string `json:"text"`
+  Text string `json:"text,omitempty"`
+  InlineData *InlineData `json:"inline_data,omitempty"`
+  FunctionCall *FunctionCall `json:"functionCall,omitempty"`
+  FunctionResponse *FunctionResponse `json:"functionResponse,omitempty"`
+}
+
+type InlineData struct {
+  MIMEType string `json:"mime_type"`
+  // Data is base64 encoded
+  Data string `json:"data"`
+}
+
+type FunctionCall struct {
+  Name string `json:"name"`
+  Args json.RawMessage `json:"args,omitempty"`
+}
+
+type FunctionResponse struct {
+  Name string `json:"name"`
+  Response json.RawMessage `json:"response"`
 }
 
 type Content struct {
@@ -163,9 +321,88 @@ type Content struct {
 type GRequestBody struct {
   Model string `json:"model"`
   Contents []Content `json:"contents"`
+  Tools []GTool `json:"tools,omitempty"`
+  ToolConfig *GToolConfig `json:"toolConfig,omitempty"`
   GenerationConfig *GenerationConfig `json:"generationConfig,omitempty"`
 }
 
+type GTool struct {
+  FunctionDeclarations []GFunctionDeclaration `json:"functionDeclarations"`
+}
+
+type GFunctionDeclaration struct {
+  Name string `json:"name"`
+  Description string `json:"description,omitempty"`
+  Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+type GToolConfig struct {
+  FunctionCallingConfig struct {
+    // Mode is AUTO, ANY or NONE
+    Mode string `json:"mode"`
+    AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+  } `json:"functionCallingConfig"`
+}
+
 type GenerationConfig struct {
-  ResponseMIMEType string `json:"response_mime_type"`
+  ResponseMIMEType string `json:"response_mime_type,omitempty"`
+  ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
+  Temperature *float64 `json:"temperature,omitempty"`
+  TopP *float64 `json:"top_p,omitempty"`
+  MaxOutputTokens *int `json:"max_output_tokens,omitempty"`
+  StopSequences []string `json:"stop_sequences,omitempty"`
+  Seed *int64 `json:"seed,omitempty"`
+  PresencePenalty *float64 `json:"presence_penalty,omitempty"`
+  FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+}
+
+// anthropic-specific structures
+type ANTMessage struct {
+  Role string `json:"role"`
+  Content []ANTBlock `json:"content"`
+}
+
+// ANTBlock is a text, image, tool_use or tool_result content block
+type ANTBlock struct {
+  Type string `json:"type"`
+  Text string `json:"text,omitempty"`
+  Source *ANTImageSource `json:"source,omitempty"`
+  ID string `json:"id,omitempty"`
+  Name string `json:"name,omitempty"`
+  Input json.RawMessage `json:"input,omitempty"`
+  ToolUseID string `json:"tool_use_id,omitempty"`
+  Content string `json:"content,omitempty"`
+}
+
+type ANTImageSource struct {
+  // Type is base64 or url
+  Type string `json:"type"`
+  MediaType string `json:"media_type,omitempty"`
+  Data string `json:"data,omitempty"`
+  URL string `json:"url,omitempty"`
+}
+
+type ANTTool struct {
+  Name string `json:"name"`
+  Description string `json:"description,omitempty"`
+  InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type ANTToolChoice struct {
+  // Type is auto, any, tool or none
+  Type string `json:"type"`
+  Name string `json:"name,omitempty"`
+}
+
+type ANTRequestBody struct {
+  Model string `json:"model"`
+  MaxTokens int `json:"max_tokens"`
+  System string `json:"system,omitempty"`
+  Messages []ANTMessage `json:"messages"`
+  Temperature *float64 `json:"temperature,omitempty"`
+  TopP *float64 `json:"top_p,omitempty"`
+  StopSequences []string `json:"stop_sequences,omitempty"`
+  Tools []ANTTool `json:"tools,omitempty"`
+  ToolChoice *ANTToolChoice `json:"tool_choice,omitempty"`
+  Stream bool `json:"stream,omitempty"`
 }
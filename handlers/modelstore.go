@@ -0,0 +1,521 @@
+package handlers
+
+import (
+  "bytes"
+  "context"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo"
+  "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var modelsCollection *mongo.Collection
+var modelAuditCollection *mongo.Collection
+
+// StoredModel is a catalog entry in the models collection. Retired models
+// are kept so their audit trail and past usage still resolve.
+type StoredModel struct {
+  Company string `json:"company" bson:"company"`
+  Model string `json:"model" bson:"model"`
+  ModelSpec `bson:",inline"`
+  // Source is models.json for entries that follow the file and admin once
+  // they were created or edited through the API
+  Source string `json:"source,omitempty" bson:"source,omitempty"`
+  Retired bool `json:"retired" bson:"retired"`
+  Updated time.Time `json:"updated" bson:"updated"`
+}
+
+// Where a stored model and its changes come from
+const (
+  modelSourceFile = "models.json"
+  modelSourceAdmin = "admin"
+)
+
+// ModelAudit records one change to the catalog, made by an admin or by an
+// edit of models.json
+type ModelAudit struct {
+  Company string `json:"company" bson:"company"`
+  Model string `json:"model" bson:"model"`
+  // Action is create, update or retire
+  Action string `json:"action" bson:"action"`
+  Before *ModelSpec `json:"before,omitempty" bson:"before,omitempty"`
+  After *ModelSpec `json:"after,omitempty" bson:"after,omitempty"`
+  Source string `json:"source" bson:"source"`
+  // CatalogVersion is the models.json version a file change came from
+  CatalogVersion string `json:"catalog_version,omitempty" bson:"catalog_version,omitempty"`
+  RemoteIP string `json:"remote_ip,omitempty" bson:"remote_ip,omitempty"`
+  Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// ensureModelIndexes makes company and model unique and orders audit trails
+func ensureModelIndexes(ctx context.Context) {
+  _, err := modelsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+    Keys: bson.D{{Key: "company", Value: 1}, {Key: "model", Value: 1}},
+    Options: options.Index().SetUnique(true),
+  })
+  if err != nil {
+    log.Printf("Error creating models index: %v", err)
+  }
+
+  _, err = modelAuditCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+    Keys: bson.D{{Key: "company", Value: 1}, {Key: "model", Value: 1}, {Key: "timestamp", Value: -1}},
+  })
+  if err != nil {
+    log.Printf("Error creating model_audit index: %v", err)
+  }
+}
+
+// seedModels applies models.json to the collection: models it doesn't have
+// yet are added and models that still follow the file get its changes, each
+// with an audit record. Models an admin created, edited or retired are left
+// alone, the collection wins for them.
+func seedModels(ctx context.Context, catalog *ModelCatalog) error {
+  cursor, err := modelsCollection.Find(ctx, bson.M{})
+  if err != nil {
+    return err
+  }
+  var stored []StoredModel
+  if err := cursor.All(ctx, &stored); err != nil {
+    return err
+  }
+  existing := map[string]StoredModel{}
+  for _, entry := range stored {
+    existing[entry.Company+"/"+entry.Model] = entry
+  }
+
+  // Entries seeded before sources were recorded follow the file unless their
+  // audit trail shows an admin change
+  edited, err := adminEditedModels(ctx)
+  if err != nil {
+    return err
+  }
+
+  now := time.Now().UTC()
+  for company, companyModels := range catalog.Companies {
+    for model, spec := range companyModels.Models {
+      key := company + "/" + model
+      previous, found := existing[key]
+      if found && (previous.Retired || previous.Source == modelSourceAdmin || previous.Source == "" && edited[key]) {
+        continue
+      }
+
+      filter := bson.M{"company": company, "model": model}
+      audit := ModelAudit{Company: company, Model: model, Action: "create", Source: modelSourceFile, CatalogVersion: catalog.Version, Timestamp: now}
+      if found {
+        archivePrice(previous.ModelSpec, &spec, now.Truncate(time.Second))
+        if sameSpec(previous.ModelSpec, spec) {
+          if previous.Source == "" {
+            if _, err := modelsCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"source": modelSourceFile}}); err != nil {
+              return err
+            }
+          }
+          continue
+        }
+        before := previous.ModelSpec
+        audit.Action, audit.Before = "update", &before
+        // An admin edit made in the meantime wins
+        filter["updated"] = previous.Updated
+      }
+      after := spec
+      audit.After = &after
+
+      if _, err := modelAuditCollection.InsertOne(ctx, audit); err != nil {
+        return err
+      }
+      entry := StoredModel{Company: company, Model: model, ModelSpec: spec, Source: modelSourceFile, Updated: now}
+      if found {
+        _, err = modelsCollection.ReplaceOne(ctx, filter, entry)
+      } else {
+        // Another instance may have added it first
+        _, err = modelsCollection.InsertOne(ctx, entry)
+        if mongo.IsDuplicateKeyError(err) {
+          err = nil
+        }
+      }
+      if err != nil {
+        return err
+      }
+      log.Printf("Applied models.json version %s to %s/%s (%s)", catalog.Version, company, model, audit.Action)
+    }
+  }
+  return nil
+}
+
+// adminEditedModels lists the models with an admin change in their audit
+// trail, keyed by company/model
+func adminEditedModels(ctx context.Context) (map[string]bool, error) {
+  cursor, err := modelAuditCollection.Aggregate(ctx, mongo.Pipeline{
+    {{Key: "$match", Value: bson.M{"source": bson.M{"$ne": modelSourceFile}}}},
+    {{Key: "$group", Value: bson.M{"_id": bson.M{"company": "$company", "model": "$model"}}}},
+  })
+  if err != nil {
+    return nil, err
+  }
+  var groups []struct {
+    ID struct {
+      Company string `bson:"company"`
+      Model string `bson:"model"`
+    } `bson:"_id"`
+  }
+  if err := cursor.All(ctx, &groups); err != nil {
+    return nil, err
+  }
+
+  edited := map[string]bool{}
+  for _, group := range groups {
+    edited[group.ID.Company+"/"+group.ID.Model] = true
+  }
+  return edited, nil
+}
+
+// Specs are compared as they are served
+func sameSpec(a ModelSpec, b ModelSpec) bool {
+  aJSON, aErr := json.Marshal(a)
+  bJSON, bErr := json.Marshal(b)
+  return aErr == nil && bErr == nil && bytes.Equal(aJSON, bJSON)
+}
+
+// loadStoredCatalog builds a catalog from the active models in the collection
+func loadStoredCatalog(ctx context.Context, modified time.Time) (*ModelCatalog, error) {
+  cursor, err := modelsCollection.Find(ctx, bson.M{"retired": bson.M{"$ne": true}})
+  if err != nil {
+    return nil, err
+  }
+  var stored []StoredModel
+  if err := cursor.All(ctx, &stored); err != nil {
+    return nil, err
+  }
+
+  companies := map[string]CompanyModels{}
+  for _, entry := range stored {
+    if _, ok := companies[entry.Company]; !ok {
+      companies[entry.Company] = CompanyModels{Models: map[string]ModelSpec{}}
+    }
+    companies[entry.Company].Models[entry.Model] = entry.ModelSpec
+  }
+  if err := validateCatalog(companies); err != nil {
+    return nil, err
+  }
+
+  // Maps are marshalled with sorted keys, so equal catalogs share a version
+  encoded, err := json.Marshal(companies)
+  if err != nil {
+    return nil, err
+  }
+  digest := sha256.Sum256(encoded)
+  return &ModelCatalog{
+    Companies: companies,
+    Version: hex.EncodeToString(digest[:])[:12],
+    Modified: modified,
+    Loaded: time.Now(),
+  }, nil
+}
+
+// refreshModelCatalog picks up changes other instances made to the collection
+func refreshModelCatalog() error {
+  catalogReloadMu.Lock()
+  defer catalogReloadMu.Unlock()
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  current := currentCatalog()
+  catalog, err := loadStoredCatalog(ctx, current.Modified)
+  if err != nil {
+    return err
+  }
+  if catalog.Version != current.Version {
+    modelCatalog.Store(catalog)
+    log.Printf("Loaded model catalog version %s", catalog.Version)
+  }
+  return nil
+}
+
+func findStoredModel(ctx context.Context, company string, model string) (StoredModel, error) {
+  var stored StoredModel
+  err := modelsCollection.FindOne(ctx, bson.M{"company": company, "model": model}).Decode(&stored)
+  return stored, err
+}
+
+// parseModelSpec reads a spec from the body and checks it fits in the catalog
+// next to every other active model. When updating, a changed price moves the
+// previous one into the price history.
+func parseModelSpec(c *fiber.Ctx, company string, model string, previous *ModelSpec) (ModelSpec, error) {
+  var spec ModelSpec
+  decoder := json.NewDecoder(bytes.NewReader(c.Body()))
+  decoder.DisallowUnknownFields()
+  if err := decoder.Decode(&spec); err != nil {
+    return spec, fmt.Errorf("Cannot parse JSON: %v", err)
+  }
+  if previous != nil {
+    archivePrice(*previous, &spec, time.Now().UTC().Truncate(time.Second))
+  }
+
+  if _, ok := getProvider(company); !ok {
+    return spec, fmt.Errorf("Provider %s is not registered", company)
+  }
+
+  companies := map[string]CompanyModels{}
+  for companyName, companyModels := range currentCatalog().Companies {
+    models := map[string]ModelSpec{}
+    for modelName, existing := range companyModels.Models {
+      models[modelName] = existing
+    }
+    companies[companyName] = CompanyModels{Models: models}
+  }
+  if _, ok := companies[company]; !ok {
+    companies[company] = CompanyModels{Models: map[string]ModelSpec{}}
+  }
+  companies[company].Models[model] = spec
+  return spec, validateCatalog(companies)
+}
+
+// recordModelAudit writes the audit record of an admin change. It is written
+// before the change, so a change that can't be audited is never made.
+func recordModelAudit(c *fiber.Ctx, ctx context.Context, audit ModelAudit) error {
+  audit.Source = modelSourceAdmin
+  audit.RemoteIP = c.IP()
+  audit.Timestamp = time.Now().UTC()
+  _, err := modelAuditCollection.InsertOne(ctx, audit)
+  return err
+}
+
+// applyModelChange reloads the catalog so the change is served right away
+func applyModelChange() error {
+  if err := refreshModelCatalog(); err != nil {
+    log.Printf("Error reloading model catalog: %v", err)
+    return err
+  }
+  return nil
+}
+
+func ListStoredModelsHandler(c *fiber.Ctx) error {
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  cursor, err := modelsCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "company", Value: 1}, {Key: "model", Value: 1}}))
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading models",
+    })
+  }
+  stored := []StoredModel{}
+  if err := cursor.All(ctx, &stored); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading models",
+    })
+  }
+
+  return c.JSON(fiber.Map{
+    "version": currentCatalog().Version,
+    "models": stored,
+  })
+}
+
+// CreateModelHandler adds a model, or brings back a retired one
+func CreateModelHandler(c *fiber.Ctx) error {
+  company, model := c.Params("company"), c.Params("model")
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  existing, err := findStoredModel(ctx, company, model)
+  if err == nil && !existing.Retired {
+    return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s already exists for %s", model, company),
+    })
+  }
+  if err != nil && err != mongo.ErrNoDocuments {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading models",
+    })
+  }
+
+  spec, err := parseModelSpec(c, company, model, nil)
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  if err := recordModelAudit(c, ctx, ModelAudit{Company: company, Model: model, Action: "create", After: &spec}); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error recording the change in the model audit",
+    })
+  }
+
+  stored := StoredModel{Company: company, Model: model, ModelSpec: spec, Source: modelSourceAdmin, Updated: time.Now().UTC()}
+  _, err = modelsCollection.ReplaceOne(ctx, bson.M{"company": company, "model": model}, stored, options.Replace().SetUpsert(true))
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+
+  if err := applyModelChange(); err != nil {
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Model saved but the catalog could not be reloaded",
+    })
+  }
+
+  return c.Status(fiber.StatusCreated).JSON(stored)
+}
+
+// UpdateModelHandler replaces the description, prices, capabilities and
+// scores of an active model
+func UpdateModelHandler(c *fiber.Ctx) error {
+  company, model := c.Params("company"), c.Params("model")
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  existing, err := findStoredModel(ctx, company, model)
+  if err == mongo.ErrNoDocuments || err == nil && existing.Retired {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s is not available for %s", model, company),
+    })
+  }
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading models",
+    })
+  }
+
+  spec, err := parseModelSpec(c, company, model, &existing.ModelSpec)
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  before := existing.ModelSpec
+  if err := recordModelAudit(c, ctx, ModelAudit{Company: company, Model: model, Action: "update", Before: &before, After: &spec}); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error recording the change in the model audit",
+    })
+  }
+
+  stored := StoredModel{Company: company, Model: model, ModelSpec: spec, Source: modelSourceAdmin, Updated: time.Now().UTC()}
+  if _, err := modelsCollection.ReplaceOne(ctx, bson.M{"company": company, "model": model}, stored); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+
+  if err := applyModelChange(); err != nil {
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Model saved but the catalog could not be reloaded",
+    })
+  }
+
+  return c.JSON(stored)
+}
+
+// RetireModelHandler stops a model from being served, its usage stays billed
+func RetireModelHandler(c *fiber.Ctx) error {
+  company, model := c.Params("company"), c.Params("model")
+
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  existing, err := findStoredModel(ctx, company, model)
+  if err == mongo.ErrNoDocuments || err == nil && existing.Retired {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s is not available for %s", model, company),
+    })
+  }
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading models",
+    })
+  }
+
+  // The last model of the catalog can't be retired
+  companies := map[string]CompanyModels{}
+  for companyName, companyModels := range currentCatalog().Companies {
+    models := map[string]ModelSpec{}
+    for modelName, spec := range companyModels.Models {
+      if companyName != company || modelName != model {
+        models[modelName] = spec
+      }
+    }
+    if len(models) > 0 {
+      companies[companyName] = CompanyModels{Models: models}
+    }
+  }
+  if err := validateCatalog(companies); err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  before := existing.ModelSpec
+  if err := recordModelAudit(c, ctx, ModelAudit{Company: company, Model: model, Action: "retire", Before: &before}); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error recording the change in the model audit",
+    })
+  }
+
+  _, err = modelsCollection.UpdateOne(ctx, bson.M{"company": company, "model": model}, bson.M{
+    "$set": bson.M{"retired": true, "source": modelSourceAdmin, "updated": time.Now().UTC()},
+  })
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+
+  if err := applyModelChange(); err != nil {
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Model retired but the catalog could not be reloaded",
+    })
+  }
+
+  return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ModelAuditHandler lists the changes made to a model, newest first
+func ModelAuditHandler(c *fiber.Ctx) error {
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  filter := bson.M{"company": c.Params("company"), "model": c.Params("model")}
+  cursor, err := modelAuditCollection.Find(ctx, filter, options.Find().SetSort(bson.M{"timestamp": -1}))
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading model audit",
+    })
+  }
+  audits := []ModelAudit{}
+  if err := cursor.All(ctx, &audits); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading model audit",
+    })
+  }
+
+  return c.JSON(fiber.Map{
+    "company": c.Params("company"),
+    "model": c.Params("model"),
+    "changes": audits,
+  })
+}
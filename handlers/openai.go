@@ -1,186 +1,194 @@
 package handlers
 
 import (
-  "context"
-  "time"
   "bytes"
+  "context"
   "encoding/json"
+  "errors"
   "net/http"
-  "os"
-  "io/ioutil"
-  "fmt"
-  "log"
-  "strings"
 
   "github.com/gofiber/fiber/v2"
-  "go.mongodb.org/mongo-driver/bson"
-  "go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func OpenAIResponseJSON(requestBody OAIRequestBody) ([]byte, int, error) {
-  // Set openai API key and endpoint
-  OAIKey := os.Getenv("OPENAI_API_KEY")
-  if OAIKey == "" {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "OPENAI_API_KEY is not set")
+func newOpenAIRequest(requestBody OAIRequestBody) (*http.Request, error) {
+  // Check the openai API keys and set the endpoint, the key is added per attempt
+  if !getKeyPool("openai").configured() {
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "OPENAI_API_KEY is not set")
   }
-  url := "https://api.openai.com/v1/chat/completions"
+  url := upstreamURL("openai", "/v1/chat/completions")
 
   // Convert request body to JSON
   jsonBody, err := json.Marshal(requestBody)
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error marshalling JSON")
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error marshalling JSON")
   }
 
   // Make HTTP request
   req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonBody))
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
   }
 
   // Add headers
   req.Header.Set("Content-Type", "application/json")
-  req.Header.Set("Authorization", "Bearer "+OAIKey)
 
-  // Send request
-  client := &http.Client{}
-  resp, err := client.Do(req)
+  return req, nil
+}
+
+func OpenAIResponseJSON(ctx context.Context, requestBody OAIRequestBody) ([]byte, int, error) {
+  req, err := newOpenAIRequest(requestBody)
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error sending request")
+    return nil, http.StatusInternalServerError, err
   }
-  defer resp.Body.Close()
 
-  // Read response
-  body, err := ioutil.ReadAll(resp.Body)
+  // Send request
+  return upstreamCall(ctx, "openai", req)
+}
+
+// OpenAIStream opens a chat.completion.chunk event stream, the caller closes the body
+func OpenAIStream(ctx context.Context, requestBody OAIRequestBody) (*http.Response, error) {
+  req, err := newOpenAIRequest(requestBody)
   if err != nil {
-    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error reading response")
+    return nil, err
   }
 
-  return body, resp.StatusCode, nil
+  // Send request
+  return upstreamStream(ctx, "openai", req)
 }
 
-func OpenAIHandler(c *fiber.Ctx) error {
-  // Read requestBody
-  var requestBody RequestBody
-  if err := c.BodyParser(&requestBody); err != nil {
-    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-      "error": "Cannot parse JSON",
-    })
-  }
- 
-  // Validate if the model belongs to openai
-  openAIMessages, _, err := processRequest(requestBody)
+type openAIProvider struct{}
+
+func (openAIProvider) BuildRequest(body RequestBody) (interface{}, error) {
+  openAIMessages, _, err := processRequest(body)
+  if err != nil {
+    return nil, err
+  }
+  generation, err := body.generation("openai", openAIGeneration)
   if err != nil {
-    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-      "error": err.Error(),
-    })
+    return nil, err
   }
 
   // Create openai' request body
   oaiRequestBody := OAIRequestBody{
-    Model: requestBody.Model,
+    Model: body.Model,
     Messages: openAIMessages,
-  }
-
-  // Config default settings
-  if requestBody.OutputJSON == nil || *requestBody.OutputJSON {
+    Temperature: generation.Temperature,
+    TopP: generation.TopP,
+    MaxTokens: generation.MaxTokens,
+    Stop: generation.Stop,
+    Seed: generation.Seed,
+    PresencePenalty: generation.PresencePenalty,
+    FrequencyPenalty: generation.FrequencyPenalty,
+    Tools: body.Tools,
+    ToolChoice: body.ToolChoice,
+  }
+
+  // Config default settings, a schema is enforced with strict mode
+  if body.OutputSchema != nil {
+    oaiRequestBody.ResponseFormat = &ResponseFormat{
+      Type: "json_schema",
+      JSONSchema: &JSONSchemaFormat{Name: body.OutputSchema.name(), Schema: body.OutputSchema.Schema, Strict: true},
+    }
+  } else if body.OutputJSON == nil || *body.OutputJSON {
     oaiRequestBody.ResponseFormat = &ResponseFormat{
       Type: "json_object",
     }
   }
-  
-  // Make openai' request
-  response, statusCode, err := OpenAIResponseJSON(oaiRequestBody)
-  if err != nil {
-    return c.Status(statusCode).JSON(fiber.Map{
-      "error": err.Error(),
-    })
+
+  // Ask for the usage chunk at the end of the stream so it can be billed
+  if body.Stream != nil && *body.Stream {
+    oaiRequestBody.Stream = true
+    oaiRequestBody.StreamOptions = &StreamOptions{IncludeUsage: true}
   }
 
-  // If request is not successful, don't update the database
-  if statusCode != http.StatusOK {
-    return c.Status(statusCode).Send(response)
+  return oaiRequestBody, nil
+}
+
+func (openAIProvider) Call(ctx context.Context, payload interface{}) ([]byte, int, error) {
+  return OpenAIResponseJSON(ctx, payload.(OAIRequestBody))
+}
+
+type openAIUsage struct {
+  PromptTokens int `json:"prompt_tokens"`
+  CompletionTokens int `json:"completion_tokens"`
+  TotalTokens int `json:"total_tokens"`
+  PromptTokensDetails struct {
+    CachedTokens int `json:"cached_tokens"`
+  } `json:"prompt_tokens_details"`
+}
+
+// Cached tokens are part of prompt_tokens but billed at the cached price
+func (usage openAIUsage) tokenUsage() TokenUsage {
+  cached := usage.PromptTokensDetails.CachedTokens
+  return TokenUsage{
+    InputTokens: usage.PromptTokens - cached,
+    OutputTokens: usage.CompletionTokens,
+    CachedInputTokens: cached,
   }
+}
 
-  // Parse response to get token usage
+func (openAIProvider) ParseUsage(response []byte) (TokenUsage, error) {
   var openAIResponse struct {
-    Usage struct {
-      PromptTokens int `json:"prompt_tokens"`
-      CompletionTokens int `json:"completion_tokens"`
-      TotalTokens int `json:"total_tokens"`
-    } `json:"usage"`
+    Usage openAIUsage `json:"usage"`
   }
   if err := json.Unmarshal(response, &openAIResponse); err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error parsing response JSON",
-    })
+    return TokenUsage{}, err
   }
 
-  // Get model prices from models.json
-  inputPrice, outputPrice, err := getModelPrices(requestBody.Model, "openai")
-  if err != nil {
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error getting model prices",
-    })
+  return openAIResponse.Usage.tokenUsage(), nil
+}
+
+func (openAIProvider) Stream(ctx context.Context, payload interface{}) (*http.Response, error) {
+  return OpenAIStream(ctx, payload.(OAIRequestBody))
+}
+
+// Only the final chunk carries usage when include_usage is set
+func (openAIProvider) ParseStreamUsage(data []byte, usage *TokenUsage) {
+  var chunk struct {
+    Usage *openAIUsage `json:"usage"`
+  }
+  if err := json.Unmarshal(data, &chunk); err != nil || chunk.Usage == nil {
+    return
   }
 
-  // Calculate usage 
-  inputTokens := openAIResponse.Usage.PromptTokens
-  outputTokens := openAIResponse.Usage.CompletionTokens
-  inputUsage := float64(inputTokens) * (inputPrice / 1000000)
-  outputUsage := float64(outputTokens) * (outputPrice / 1000000)
+  *usage = chunk.Usage.tokenUsage()
+}
 
-  // Update MongoDB
-  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-  defer cancel()
+func (openAIProvider) StructuredOutput(response []byte) (string, error) {
+  var openAIResponse struct {
+    Choices []struct {
+      Message struct {
+        Content string `json:"content"`
+        Refusal string `json:"refusal"`
+      } `json:"message"`
+    } `json:"choices"`
+  }
+  if err := json.Unmarshal(response, &openAIResponse); err != nil || len(openAIResponse.Choices) == 0 {
+    return "", errors.New("the response has no output")
+  }
 
-  userID := requestBody.ID
-  filter := bson.M{"id_user": userID}
+  message := openAIResponse.Choices[0].Message
+  if message.Refusal != "" {
+    return "", errors.New("the model refused: " + message.Refusal)
+  }
+  return message.Content, nil
+}
 
-  // Check if the user exists
-  var user User
-  err = userCollection.FindOne(ctx, filter).Decode(&user)
-  if err != nil {
-    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-      "error": "User not found",
-    })
-  }
-
-  // Ensure the model name with dot notation is handled properly
-  modelKey := fmt.Sprintf("openai.models.%s", strings.Replace(requestBody.Model, ".", "\u2024", -1))
-
-  update := bson.M{
-    "$inc": bson.M{
-      "input_usage": inputUsage,
-      "output_usage": outputUsage,
-      "openai.input_usage": inputUsage,
-      "openai.output_usage": outputUsage,
-      modelKey + ".input_tokens": inputTokens,
-      modelKey + ".output_tokens": outputTokens,
-      modelKey + ".input_usage":  inputUsage,
-      modelKey + ".output_usage": outputUsage,
-    },
-    "$push": bson.M{
-      "history": History{
-        Company: "openai",
-        Model: requestBody.Model,
-        InputTokens: inputTokens,
-        OutputTokens: outputTokens,
-        InputUsage: inputUsage,
-        OutputUsage: outputUsage,
-        Created: time.Now().Unix(),
-      },
-    },
-  }
-  opts := options.Update().SetUpsert(false)
-  _, err = userCollection.UpdateOne(ctx, filter, update, opts)
+func (openAIProvider) APIKeyEnv() string {
+  return "OPENAI_API_KEY"
+}
+
+func (openAIProvider) Authorize(req *http.Request, key string) {
+  req.Header.Set("Authorization", "Bearer "+key)
+}
+
+// Listing models is free, so it is used to validate the key
+func (provider openAIProvider) CheckAPIKey(key string) (int, error) {
+  req, err := http.NewRequest("GET", upstreamURL("openai", "/v1/models"), nil)
   if err != nil {
-    log.Printf("%v", err)
-    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-      "error": "Error updating MongoDB",
-    })
+    return 0, err
   }
+  provider.Authorize(req, key)
 
-  // Return response
-  return c.Status(statusCode).Send(response)
+  return checkKeyRequest(req)
 }
-
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+  "context"
+  "fmt"
+  "log"
+  "sort"
+  "time"
+
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo"
+)
+
+// initialPriceVersion names a price without an effective_from date
+const initialPriceVersion = "initial"
+
+// PricePeriod is an earlier or scheduled price of a model, it applies from
+// EffectiveFrom (inclusive) to EffectiveTo (exclusive), unset dates are open
+type PricePeriod struct {
+  EffectiveFrom *time.Time `json:"effective_from,omitempty" bson:"effective_from,omitempty"`
+  EffectiveTo *time.Time `json:"effective_to,omitempty" bson:"effective_to,omitempty"`
+  PricePerTokens *TokenPrices `json:"price_per_1million_tokens,omitempty" bson:"price_per_1million_tokens,omitempty"`
+  PricePerMinute float64 `json:"price_per_minute,omitempty" bson:"price_per_minute,omitempty"`
+}
+
+// ModelPrice is the price applied to one call, with every tier resolved
+type ModelPrice struct {
+  // Version is the effective_from date of the price, or "initial"
+  Version string
+  // Token prices are in USD per million tokens
+  Input float64
+  Output float64
+  CachedInput float64
+  CacheWrite float64
+  PerMinute float64
+}
+
+func (period PricePeriod) covers(at time.Time) bool {
+  if period.EffectiveFrom != nil && at.Before(*period.EffectiveFrom) {
+    return false
+  }
+  return period.EffectiveTo == nil || at.Before(*period.EffectiveTo)
+}
+
+func (period PricePeriod) price() ModelPrice {
+  price := ModelPrice{Version: priceVersion(period.EffectiveFrom), PerMinute: period.PricePerMinute}
+  if prices := period.PricePerTokens; prices != nil {
+    price.Input = prices.Input
+    price.Output = prices.Output
+    price.CachedInput = priceTier(prices.CachedInput, prices.Input)
+    price.CacheWrite = priceTier(prices.CacheWrite, prices.Input)
+  }
+  return price
+}
+
+func priceTier(tier *float64, fallback float64) float64 {
+  if tier == nil {
+    return fallback
+  }
+  return *tier
+}
+
+// tokenCost splits the cost of a call into its input and output parts
+func tokenCost(usage TokenUsage, price ModelPrice) (float64, float64) {
+  input := float64(usage.InputTokens) * price.Input
+  input += float64(usage.CachedInputTokens) * price.CachedInput
+  input += float64(usage.CacheWriteTokens) * price.CacheWrite
+  return input / 1000000, float64(usage.OutputTokens) * (price.Output / 1000000)
+}
+
+func priceVersion(effectiveFrom *time.Time) string {
+  if effectiveFrom == nil {
+    return initialPriceVersion
+  }
+  return effectiveFrom.UTC().Format(time.RFC3339)
+}
+
+// currentPeriod is the model's top level price
+func (spec ModelSpec) currentPeriod() PricePeriod {
+  return PricePeriod{
+    EffectiveFrom: spec.EffectiveFrom,
+    PricePerTokens: spec.PricePerTokens,
+    PricePerMinute: spec.PricePerMinute,
+  }
+}
+
+// PriceAt returns the price that applied at a point in time. A price_history
+// period covering it wins over the top level price.
+func (spec ModelSpec) PriceAt(at time.Time) ModelPrice {
+  for _, period := range spec.PriceHistory {
+    if period.covers(at) {
+      return period.price()
+    }
+  }
+  return spec.currentPeriod().price()
+}
+
+// validatePrices checks the price history of a model whose top level price
+// is already valid: periods use the same kind of price, don't overlap and only
+// one price may omit effective_from
+func validatePrices(company string, model string, spec ModelSpec) error {
+  undated := 0
+  if spec.EffectiveFrom == nil {
+    undated++
+  }
+
+  periods := append([]PricePeriod(nil), spec.PriceHistory...)
+  for _, period := range periods {
+    if period.EffectiveFrom == nil {
+      undated++
+    }
+    if period.EffectiveFrom == nil && period.EffectiveTo == nil {
+      return fmt.Errorf("%s/%s has a price_history entry without dates", company, model)
+    }
+    if period.EffectiveFrom != nil && period.EffectiveTo != nil && !period.EffectiveTo.After(*period.EffectiveFrom) {
+      return fmt.Errorf("%s/%s has a price_history entry ending before it starts", company, model)
+    }
+    if (period.PricePerTokens != nil) != (spec.PricePerTokens != nil) || (period.PricePerMinute != 0) != (spec.PricePerMinute != 0) {
+      return fmt.Errorf("%s/%s mixes token and per minute prices in price_history", company, model)
+    }
+    if period.PricePerTokens != nil && period.PricePerTokens.negative() || period.PricePerMinute < 0 {
+      return fmt.Errorf("%s/%s has a negative price in price_history", company, model)
+    }
+  }
+  if undated > 1 {
+    return fmt.Errorf("%s/%s has more than one price without effective_from", company, model)
+  }
+
+  // Sorted by start, each period has to end before the next one starts
+  sort.Slice(periods, func(i, j int) bool {
+    return periods[i].EffectiveFrom == nil || periods[j].EffectiveFrom != nil && periods[i].EffectiveFrom.Before(*periods[j].EffectiveFrom)
+  })
+  for i := 1; i < len(periods); i++ {
+    previous := periods[i-1]
+    if previous.EffectiveTo == nil || previous.EffectiveTo.After(*periods[i].EffectiveFrom) {
+      return fmt.Errorf("%s/%s has overlapping price_history entries", company, model)
+    }
+  }
+  return nil
+}
+
+// archivePrice keeps the previous price in the history when an update changes
+// it without managing the history itself, the new price starts now
+func archivePrice(previous ModelSpec, spec *ModelSpec, now time.Time) {
+  if spec.PriceHistory != nil || spec.EffectiveFrom != nil {
+    return
+  }
+
+  spec.PriceHistory = previous.PriceHistory
+  if samePrice(previous, *spec) {
+    spec.EffectiveFrom = previous.EffectiveFrom
+    return
+  }
+
+  archived := previous.currentPeriod()
+  archived.EffectiveTo = &now
+  spec.PriceHistory = append(append([]PricePeriod(nil), previous.PriceHistory...), archived)
+  spec.EffectiveFrom = &now
+}
+
+// Prices are compared with their tiers resolved, the dates don't matter
+func samePrice(a ModelSpec, b ModelSpec) bool {
+  if (a.PricePerTokens == nil) != (b.PricePerTokens == nil) {
+    return false
+  }
+  aPrice, bPrice := a.currentPeriod().price(), b.currentPeriod().price()
+  aPrice.Version, bPrice.Version = "", ""
+  return aPrice == bPrice
+}
+
+// RecalculationResult summarises a RecalculateUsage run
+type RecalculationResult struct {
+  Events int
+  Changed int
+  // Skipped events belong to models missing from the models collection
+  Skipped int
+  Delta float64
+}
+
+// RecalculateUsage reprices the usage events between from and to (dates or
+// RFC 3339 timestamps, to is inclusive for dates) with the price that applied
+// when each call was made, and moves the users' aggregates by the difference.
+// It is safe to re-run, events already at the right price are left alone.
+func RecalculateUsage(ctx context.Context, from string, to string, company string, model string, dryRun bool) (RecalculationResult, error) {
+  var result RecalculationResult
+
+  filter := bson.M{}
+  timestamp := bson.M{}
+  if from != "" {
+    t, err := parseReportTime(from)
+    if err != nil {
+      return result, fmt.Errorf("from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+    }
+    timestamp["$gte"] = t
+  }
+  if to != "" {
+    t, err := parseReportTime(to)
+    if err != nil {
+      return result, fmt.Errorf("to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+    }
+    if len(to) == len("2006-01-02") {
+      t = t.AddDate(0, 0, 1)
+    }
+    timestamp["$lt"] = t
+  }
+  if len(timestamp) > 0 {
+    filter["timestamp"] = timestamp
+  }
+  if company != "" {
+    filter["company"] = company
+  }
+  if model != "" {
+    filter["model"] = model
+  }
+
+  // Retired models are included, their past calls still need a price
+  specs := map[string]ModelSpec{}
+  cursor, err := modelsCollection.Find(ctx, bson.M{})
+  if err != nil {
+    return result, err
+  }
+  var stored []StoredModel
+  if err := cursor.All(ctx, &stored); err != nil {
+    return result, err
+  }
+  for _, entry := range stored {
+    specs[entry.Company+"/"+entry.Model] = entry.ModelSpec
+  }
+
+  events, err := usageCollection.Find(ctx, filter)
+  if err != nil {
+    return result, err
+  }
+  defer events.Close(ctx)
+
+  for events.Next(ctx) {
+    var event struct {
+      ID interface{} `bson:"_id"`
+      History `bson:",inline"`
+    }
+    if err := events.Decode(&event); err != nil {
+      return result, err
+    }
+    result.Events++
+
+    spec, ok := specs[event.Company+"/"+event.Model]
+    if !ok {
+      result.Skipped++
+      continue
+    }
+
+    at := event.Timestamp
+    if at.IsZero() {
+      at = time.Unix(event.Created, 0)
+    }
+    price := spec.PriceAt(at)
+
+    var inputUsage, outputUsage float64
+    if event.AudioSeconds > 0 {
+      inputUsage = event.AudioSeconds * (price.PerMinute / 60)
+    } else {
+      inputUsage, outputUsage = tokenCost(TokenUsage{
+        InputTokens: event.InputTokens,
+        OutputTokens: event.OutputTokens,
+        CachedInputTokens: event.CachedInputTokens,
+        CacheWriteTokens: event.CacheWriteTokens,
+      }, price)
+    }
+
+    inputDelta := inputUsage - event.InputUsage
+    outputDelta := outputUsage - event.OutputUsage
+    if inputDelta == 0 && outputDelta == 0 && event.PriceVersion == price.Version {
+      continue
+    }
+    result.Changed++
+    result.Delta += inputDelta + outputDelta
+    if dryRun {
+      continue
+    }
+
+    _, err := usageCollection.UpdateOne(ctx, bson.M{"_id": event.ID}, bson.M{"$set": bson.M{
+      "input_usage": inputUsage,
+      "output_usage": outputUsage,
+      "price_version": price.Version,
+    }})
+    if err != nil {
+      return result, err
+    }
+
+    if inputDelta == 0 && outputDelta == 0 {
+      continue
+    }
+    modelKey := usageModelKey(event.Company, event.Model)
+    inc := bson.M{
+      "input_usage": inputDelta,
+      "output_usage": outputDelta,
+      event.Company + ".input_usage": inputDelta,
+      event.Company + ".output_usage": outputDelta,
+      modelKey + ".input_usage": inputDelta,
+      modelKey + ".output_usage": outputDelta,
+    }
+    addMonthlySpend(inc, at.UTC().Format("2006-01"), event.Company, event.Model, inputDelta+outputDelta)
+
+    if _, err := userCollection.UpdateOne(ctx, bson.M{"id_user": event.UserID}, bson.M{"$inc": inc}); err != nil && err != mongo.ErrNoDocuments {
+      return result, err
+    }
+  }
+  if err := events.Err(); err != nil {
+    return result, err
+  }
+
+  if result.Skipped > 0 {
+    log.Printf("Skipped %d events of models missing from the models collection", result.Skipped)
+  }
+  return result, nil
+}
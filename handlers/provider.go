@@ -0,0 +1,427 @@
+package handlers
+
+import (
+  "context"
+  "time"
+  "fmt"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "strconv"
+
+  "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Provider adapts the unified RequestBody to a single upstream LLM API
+type Provider interface {
+  // BuildRequest translates the unified request into the provider payload
+  BuildRequest(body RequestBody) (interface{}, error)
+  // Call sends the payload upstream and returns the raw response
+  Call(ctx context.Context, payload interface{}) ([]byte, int, error)
+  // ParseUsage extracts token counts from a successful response
+  ParseUsage(response []byte) (TokenUsage, error)
+}
+
+// StreamProvider is implemented by providers that can relay completions as SSE
+type StreamProvider interface {
+  Provider
+  // Stream opens the upstream event stream, the caller closes the body
+  Stream(ctx context.Context, payload interface{}) (*http.Response, error)
+  // ParseStreamUsage updates usage from a single SSE data payload
+  ParseStreamUsage(data []byte, usage *TokenUsage)
+}
+
+type TokenUsage struct {
+  // InputTokens are the prompt tokens billed at the full input price
+  InputTokens int
+  OutputTokens int
+  // CachedInputTokens were read from the provider's prompt cache
+  CachedInputTokens int
+  // CacheWriteTokens were written to the prompt cache
+  CacheWriteTokens int
+}
+
+// Providers are keyed by the company names used in models.json
+var providers = map[string]Provider{}
+
+func RegisterProvider(company string, provider Provider) {
+  providers[company] = provider
+}
+
+func getProvider(company string) (Provider, bool) {
+  provider, ok := providers[company]
+  return provider, ok
+}
+
+func init() {
+  RegisterProvider("openai", openAIProvider{})
+  RegisterProvider("google", googleProvider{})
+  RegisterProvider("anthropic", anthropicProvider{})
+}
+
+// ProviderHandler builds the route handler for a registered company
+func ProviderHandler(company string) fiber.Handler {
+  return func(c *fiber.Ctx) error {
+    // Read request body
+    var requestBody RequestBody
+    if err := c.BodyParser(&requestBody); err != nil {
+      return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+        "error": "Cannot parse JSON",
+      })
+    }
+
+    return handleCompletion(c, company, requestBody, nil)
+  }
+}
+
+// outputFormat rewrites successful responses before they reach the client.
+// The callbacks get the provider that actually served the request.
+type outputFormat struct {
+  // Response converts a complete response body
+  Response func(provider Provider, response []byte) ([]byte, error)
+  // Event converts one SSE data payload, nil drops the event
+  Event func(provider Provider, data []byte) []byte
+  // Done is sent as the last SSE data payload, if set
+  Done string
+}
+
+// completionTarget is one model the request may be served by
+type completionTarget struct {
+  Company string
+  Model string
+  Price ModelPrice
+}
+
+// handleCompletion validates, dispatches and bills a request for one company,
+// falling back along the model's fallback chain when the upstream fails.
+// A nil format sends the provider's native response.
+func handleCompletion(c *fiber.Ctx, company string, requestBody RequestBody, format *outputFormat) error {
+  if _, ok := getProvider(company); !ok {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": fmt.Sprintf("Provider %s is not registered", company),
+    })
+  }
+
+  // The caller is identified by its API key, not by the body
+  requestBody.ID = requestUserID(c, requestBody.ID)
+
+  // Validate if the model belongs to the company
+  price, err := getModelPrices(requestBody.Model, company)
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s is not available for %s", requestBody.Model, company),
+    })
+  }
+
+  // Images are only sent to models that can read them
+  images := requestHasImages(requestBody)
+  if images && !readsImages(company, requestBody.Model) {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s does not accept images", requestBody.Model),
+    })
+  }
+
+  // Check if the user exists before spending on the upstream call
+  user, err := findUser(requestBody.ID)
+  if err != nil {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "User not found",
+    })
+  }
+
+  // Reject the call if its estimated cost would break a budget
+  outputTokens := estimatedOutputTokens
+  if requestBody.Generation != nil && requestBody.Generation.MaxTokens != nil {
+    outputTokens = *requestBody.Generation.MaxTokens
+  }
+  estimate := estimateCost(requestBody, outputTokens, price.Input, price.Output)
+  if rejected, err := enforceBudget(c, user, company, requestBody.Model, estimate); rejected {
+    return err
+  }
+
+  // Fallbacks that can't take the request's parameters are left out
+  stream := requestBody.Stream != nil && *requestBody.Stream
+  targets := []completionTarget{{Company: company, Model: requestBody.Model, Price: price}}
+  for _, fallback := range fallbackTargets(requestBody, user) {
+    if compatibleFallback(fallback, requestBody, stream) {
+      targets = append(targets, fallback)
+    }
+  }
+  inlined := false
+  var inlineErr error
+
+  // lastFailure answers with the last upstream failure when no target is
+  // left to fall back to
+  var lastFailure func() error
+
+  for attempt, target := range targets {
+    last := attempt == len(targets)-1
+    provider, _ := getProvider(target.Company)
+
+    // Image URLs are fetched once, the first time a provider needs them
+    // inline, and the following attempts reuse the data
+    if inliner, ok := provider.(InlineImageProvider); ok && inliner.InlineImages() && images {
+      if !inlined {
+        inlined = true
+        var inlinedBody RequestBody
+        if inlinedBody, inlineErr = inlineImageURLs(requestContext(c), requestBody); inlineErr == nil {
+          requestBody = inlinedBody
+        }
+      }
+      if inlineErr != nil {
+        if attempt > 0 {
+          logFallback(target, 0, inlineErr)
+          continue
+        }
+        return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+          "error": inlineErr.Error(),
+        })
+      }
+    }
+
+    // Create the provider request body, translating the conversation for fallbacks
+    body := requestBody
+    body.Model = target.Model
+    payload, err := provider.BuildRequest(body)
+    if err != nil {
+      // A fallback may not support every parameter the request uses
+      if attempt > 0 {
+        logFallback(target, 0, err)
+        continue
+      }
+      return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+        "error": err.Error(),
+      })
+    }
+
+    // Report which model answered and after how many attempts
+    c.Set("X-Served-Provider", target.Company)
+    c.Set("X-Served-Model", target.Model)
+    c.Set("X-Attempts", strconv.Itoa(attempt+1))
+
+    if stream {
+      streamer, ok := provider.(StreamProvider)
+      if !ok {
+        if attempt == 0 {
+          lastFailure = func() error {
+            return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+              "error": fmt.Sprintf("Streaming is not supported for %s", target.Company),
+            })
+          }
+        }
+        continue
+      }
+
+      // The stream outlives the handler, so it can't use the request context.
+      // A client that goes away is noticed on the next failed write, which
+      // cancels the upstream request.
+      if !breakerAllow(target.Company, target.Model) {
+        if !last {
+          lastFailure = func() error { return breakerOpenResponse(c, target) }
+          continue
+        }
+        return breakerOpenResponse(c, target)
+      }
+
+      streamCtx, tracker := withKeyTracker(context.Background())
+      resp, err := streamer.Stream(streamCtx, payload)
+      breakerReport(target.Company, target.Model, statusOf(resp), err)
+      if err != nil {
+        if !last {
+          logFallback(target, 0, err)
+          lastFailure = func() error {
+            return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+          }
+          continue
+        }
+        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+          "error": err.Error(),
+        })
+      }
+
+      // If request is not successful, return the upstream error as is
+      if resp.StatusCode != http.StatusOK {
+        if !last && shouldFallback(resp.StatusCode) {
+          statusCode := resp.StatusCode
+          body, _ := ioutil.ReadAll(resp.Body)
+          resp.Body.Close()
+          logFallback(target, statusCode, nil)
+          lastFailure = func() error { return c.Status(statusCode).Send(body) }
+          continue
+        }
+        defer resp.Body.Close()
+        body, err := ioutil.ReadAll(resp.Body)
+        if err != nil {
+          return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+            "error": "Error reading response",
+          })
+        }
+        return c.Status(resp.StatusCode).Send(body)
+      }
+
+      return relayStream(c, streamer, resp, requestBody, target, tracker.Label(), format)
+    }
+
+    // Fail fast while the provider or model is known to be down
+    if !breakerAllow(target.Company, target.Model) {
+      if !last {
+        lastFailure = func() error { return breakerOpenResponse(c, target) }
+        continue
+      }
+      return breakerOpenResponse(c, target)
+    }
+
+    // Make the provider request
+    ctx, tracker := withKeyTracker(requestContext(c))
+    response, statusCode, err := provider.Call(ctx, payload)
+    breakerReport(target.Company, target.Model, statusCode, err)
+    if err != nil {
+      if !last && statusCode != statusClientClosed {
+        logFallback(target, 0, err)
+        lastFailure = func() error {
+          return c.Status(statusCode).JSON(fiber.Map{"error": err.Error()})
+        }
+        continue
+      }
+      return c.Status(statusCode).JSON(fiber.Map{
+        "error": err.Error(),
+      })
+    }
+
+    // If request is not successful, don't update the database
+    if statusCode != http.StatusOK {
+      if !last && shouldFallback(statusCode) {
+        logFallback(target, statusCode, nil)
+        lastFailure = func() error { return c.Status(statusCode).Send(response) }
+        continue
+      }
+      return c.Status(statusCode).Send(response)
+    }
+
+    // Parse response to get token usage
+    usage, err := provider.ParseUsage(response)
+    if err != nil {
+      return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+        "error": "Error parsing response JSON",
+      })
+    }
+
+    if err := recordUsage(requestBody.ID, target.Company, target.Model, tracker.Label(), usage, target.Price); err != nil {
+      log.Printf("%v", err)
+      return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+        "error": "Error updating MongoDB",
+      })
+    }
+
+    // Validate structured outputs, repairing them if the caller allowed it
+    if body.OutputSchema != nil {
+      var responded bool
+      response, responded, err = enforceOutputSchema(c, provider, target, body, response)
+      if responded {
+        return err
+      }
+    }
+
+    if format != nil && format.Response != nil {
+      response, err = format.Response(provider, response)
+      if err != nil {
+        return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+          "error": "Error translating response",
+        })
+      }
+    }
+
+    // Return response
+    return c.Status(statusCode).Send(response)
+  }
+
+  // Every target after the failed ones turned out to be incompatible
+  if lastFailure != nil {
+    return lastFailure()
+  }
+  return nil
+}
+
+func breakerOpenResponse(c *fiber.Ctx, target completionTarget) error {
+  return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+    "error": fmt.Sprintf("%s/%s is unavailable, try again later", target.Company, target.Model),
+  })
+}
+
+func statusOf(resp *http.Response) int {
+  if resp == nil {
+    return 0
+  }
+  return resp.StatusCode
+}
+
+// requestContext is cancelled when the client disconnects on routes behind
+// CancelOnDisconnect
+func requestContext(c *fiber.Ctx) context.Context {
+  return c.UserContext()
+}
+
+func findUser(userID string) (User, error) {
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  var user User
+  err := userCollection.FindOne(ctx, bson.M{"id_user": userID}).Decode(&user)
+  return user, err
+}
+
+// Ensure the model name with dot notation is handled properly
+func usageModelKey(company string, model string) string {
+  return fmt.Sprintf("%s.models.%s", company, escapeModelKey(model))
+}
+
+// recordUsage bills the tokens to the user's aggregates and usage events,
+// keyLabel attributes the event to the pooled key that served it
+func recordUsage(userID string, company string, model string, keyLabel string, usage TokenUsage, price ModelPrice) error {
+  // Calculate usage
+  inputUsage, outputUsage := tokenCost(usage, price)
+
+  // Update MongoDB
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  filter := bson.M{"id_user": userID}
+
+  modelKey := usageModelKey(company, model)
+
+  inc := bson.M{
+    "input_usage": inputUsage,
+    "output_usage": outputUsage,
+    company + ".input_usage": inputUsage,
+    company + ".output_usage": outputUsage,
+    modelKey + ".input_tokens": usage.InputTokens,
+    modelKey + ".output_tokens": usage.OutputTokens,
+    modelKey + ".cached_input_tokens": usage.CachedInputTokens,
+    modelKey + ".cache_write_tokens": usage.CacheWriteTokens,
+    modelKey + ".input_usage": inputUsage,
+    modelKey + ".output_usage": outputUsage,
+  }
+  addMonthlySpend(inc, currentMonth(), company, model, inputUsage+outputUsage)
+
+  update := bson.M{"$inc": inc}
+  opts := options.Update().SetUpsert(false)
+  if _, err := userCollection.UpdateOne(ctx, filter, update, opts); err != nil {
+    return err
+  }
+
+  return recordEvent(History{
+    UserID: userID,
+    Company: company,
+    Model: model,
+    InputTokens: usage.InputTokens,
+    OutputTokens: usage.OutputTokens,
+    CachedInputTokens: usage.CachedInputTokens,
+    CacheWriteTokens: usage.CacheWriteTokens,
+    InputUsage: inputUsage,
+    OutputUsage: outputUsage,
+    PriceVersion: price.Version,
+    APIKey: keyLabel,
+  })
+}
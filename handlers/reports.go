@@ -0,0 +1,245 @@
+package handlers
+
+import (
+  "context"
+  "log"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+  historyDefaultLimit = 50
+  historyMaxLimit = 500
+)
+
+type UsageGroup struct {
+  Day string `json:"day,omitempty" bson:"day,omitempty"`
+  Company string `json:"company,omitempty" bson:"company,omitempty"`
+  Model string `json:"model,omitempty" bson:"model,omitempty"`
+  APIKey string `json:"api_key,omitempty" bson:"api_key,omitempty"`
+  Requests int `json:"requests" bson:"requests"`
+  InputTokens int `json:"input_tokens" bson:"input_tokens"`
+  OutputTokens int `json:"output_tokens" bson:"output_tokens"`
+  CachedInputTokens int `json:"cached_input_tokens" bson:"cached_input_tokens"`
+  CacheWriteTokens int `json:"cache_write_tokens" bson:"cache_write_tokens"`
+  AudioSeconds float64 `json:"audio_seconds" bson:"audio_seconds"`
+  InputUsage float64 `json:"input_usage" bson:"input_usage"`
+  OutputUsage float64 `json:"output_usage" bson:"output_usage"`
+  TotalUsage float64 `json:"total_usage" bson:"total_usage"`
+}
+
+// canAccessUser lets admins read any user and users read only themselves
+func canAccessUser(c *fiber.Ctx, userID string) bool {
+  if admin, _ := c.Locals("admin").(bool); admin {
+    return true
+  }
+  authenticated, _ := c.Locals("id_user").(string)
+  return authenticated != "" && authenticated == userID
+}
+
+// Accepts RFC 3339 timestamps or plain YYYY-MM-DD dates
+func parseReportTime(value string) (time.Time, error) {
+  if t, err := time.Parse(time.RFC3339, value); err == nil {
+    return t, nil
+  }
+  return time.Parse("2006-01-02", value)
+}
+
+// usageFilter matches the user's events between the from and to query parameters
+func usageFilter(c *fiber.Ctx, userID string) (bson.M, error) {
+  filter := bson.M{"id_user": userID}
+  timestamp := bson.M{}
+
+  if from := c.Query("from"); from != "" {
+    t, err := parseReportTime(from)
+    if err != nil {
+      return nil, fiber.NewError(fiber.StatusBadRequest, "from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+    }
+    timestamp["$gte"] = t
+  }
+  if to := c.Query("to"); to != "" {
+    t, err := parseReportTime(to)
+    if err != nil {
+      return nil, fiber.NewError(fiber.StatusBadRequest, "to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+    }
+    // A plain date includes the whole day
+    if len(to) == len("2006-01-02") {
+      t = t.AddDate(0, 0, 1)
+    }
+    timestamp["$lt"] = t
+  }
+
+  if len(timestamp) > 0 {
+    filter["timestamp"] = timestamp
+  }
+  return filter, nil
+}
+
+func UsageReportHandler(c *fiber.Ctx) error {
+  userID := c.Params("id")
+  if !canAccessUser(c, userID) {
+    return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+      "error": "Not allowed to read this user's usage",
+    })
+  }
+
+  filter, err := usageFilter(c, userID)
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  // Group key and the fields it is flattened back into
+  var groupID interface{}
+  project := bson.M{"_id": 0}
+  groupBy := c.Query("group_by")
+  switch groupBy {
+  case "":
+    groupID = nil
+  case "day":
+    groupID = bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timestamp"}}
+    project["day"] = "$_id"
+  case "provider":
+    groupID = "$company"
+    project["company"] = "$_id"
+  case "model":
+    groupID = bson.M{"company": "$company", "model": "$model"}
+    project["company"] = "$_id.company"
+    project["model"] = "$_id.model"
+  case "key":
+    groupID = bson.M{"company": "$company", "api_key": "$api_key"}
+    project["company"] = "$_id.company"
+    project["api_key"] = "$_id.api_key"
+  default:
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "group_by must be one of day, key, model or provider",
+    })
+  }
+  for _, field := range []string{"requests", "input_tokens", "output_tokens", "cached_input_tokens", "cache_write_tokens", "audio_seconds", "input_usage", "output_usage"} {
+    project[field] = 1
+  }
+  project["total_usage"] = bson.M{"$add": bson.A{"$input_usage", "$output_usage"}}
+
+  pipeline := bson.A{
+    bson.M{"$match": filter},
+    bson.M{"$group": bson.M{
+      "_id": groupID,
+      "requests": bson.M{"$sum": 1},
+      "input_tokens": bson.M{"$sum": "$input_tokens"},
+      "output_tokens": bson.M{"$sum": "$output_tokens"},
+      "cached_input_tokens": bson.M{"$sum": "$cached_input_tokens"},
+      "cache_write_tokens": bson.M{"$sum": "$cache_write_tokens"},
+      "audio_seconds": bson.M{"$sum": "$audio_seconds"},
+      "input_usage": bson.M{"$sum": "$input_usage"},
+      "output_usage": bson.M{"$sum": "$output_usage"},
+    }},
+    bson.M{"$sort": bson.M{"_id": 1}},
+    bson.M{"$project": project},
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+  defer cancel()
+
+  cursor, err := usageCollection.Aggregate(ctx, pipeline)
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error aggregating usage",
+    })
+  }
+  groups := []UsageGroup{}
+  if err := cursor.All(ctx, &groups); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error aggregating usage",
+    })
+  }
+
+  var total UsageGroup
+  for _, group := range groups {
+    total.Requests += group.Requests
+    total.InputTokens += group.InputTokens
+    total.OutputTokens += group.OutputTokens
+    total.CachedInputTokens += group.CachedInputTokens
+    total.CacheWriteTokens += group.CacheWriteTokens
+    total.AudioSeconds += group.AudioSeconds
+    total.InputUsage += group.InputUsage
+    total.OutputUsage += group.OutputUsage
+    total.TotalUsage += group.TotalUsage
+  }
+
+  return c.JSON(fiber.Map{
+    "id_user": userID,
+    "from": c.Query("from"),
+    "to": c.Query("to"),
+    "group_by": groupBy,
+    "groups": groups,
+    "total": total,
+  })
+}
+
+func HistoryHandler(c *fiber.Ctx) error {
+  userID := c.Params("id")
+  if !canAccessUser(c, userID) {
+    return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+      "error": "Not allowed to read this user's usage",
+    })
+  }
+
+  filter, err := usageFilter(c, userID)
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  page := c.QueryInt("page", 1)
+  limit := c.QueryInt("limit", historyDefaultLimit)
+  if page < 1 || limit < 1 || limit > historyMaxLimit {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "page must be positive and limit between 1 and 500",
+    })
+  }
+
+  ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+  defer cancel()
+
+  total, err := usageCollection.CountDocuments(ctx, filter)
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading history",
+    })
+  }
+
+  opts := options.Find().
+    SetSort(bson.D{{Key: "timestamp", Value: -1}}).
+    SetSkip(int64((page - 1) * limit)).
+    SetLimit(int64(limit))
+  cursor, err := usageCollection.Find(ctx, filter, opts)
+  if err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading history",
+    })
+  }
+  events := []History{}
+  if err := cursor.All(ctx, &events); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error reading history",
+    })
+  }
+
+  return c.JSON(fiber.Map{
+    "id_user": userID,
+    "page": page,
+    "limit": limit,
+    "total": total,
+    "events": events,
+  })
+}
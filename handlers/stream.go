@@ -0,0 +1,128 @@
+package handlers
+
+import (
+  "bufio"
+  "bytes"
+  "encoding/json"
+  "log"
+  "net/http"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// recordStreamUsage bills a relayed stream, tests replace it
+var recordStreamUsage = recordUsage
+
+// relayStream forwards the upstream SSE events to the client as they arrive
+// and bills the usage reported by the stream once it ends. With a format the
+// data payloads are rewritten and every other line is dropped. When a write
+// to the client fails the upstream request is cancelled and the output seen
+// so far is billed.
+func relayStream(c *fiber.Ctx, streamer StreamProvider, resp *http.Response, body RequestBody, target completionTarget, keyLabel string, format *outputFormat) error {
+  c.Set("Content-Type", "text/event-stream")
+  c.Set("Cache-Control", "no-cache")
+  c.Set("Connection", "keep-alive")
+  c.Set("X-Accel-Buffering", "no")
+
+  c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+    // Closing the body cancels the upstream request
+    defer resp.Body.Close()
+
+    var usage TokenUsage
+    outputChars := 0
+    clientGone := false
+
+    scanner := bufio.NewScanner(resp.Body)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan() {
+      line := scanner.Bytes()
+      data, isData := bytes.CutPrefix(line, []byte("data:"))
+      if isData {
+        data = bytes.TrimSpace(data)
+        if len(data) > 0 && data[0] == '{' {
+          streamer.ParseStreamUsage(data, &usage)
+          outputChars += streamedChars(streamer, data)
+        }
+      }
+
+      if format != nil && format.Event != nil {
+        if !isData || len(data) == 0 || data[0] != '{' {
+          continue
+        }
+        event := format.Event(streamer, data)
+        if event == nil {
+          continue
+        }
+        line = append(append([]byte("data: "), event...), '\n')
+      }
+
+      w.Write(line)
+      if _, err := w.WriteString("\n"); err != nil {
+        clientGone = true
+        break
+      }
+      if len(line) == 0 || format != nil && format.Event != nil {
+        if err := w.Flush(); err != nil {
+          clientGone = true
+          break
+        }
+      }
+    }
+    complete := !clientGone && scanner.Err() == nil
+    if err := scanner.Err(); err != nil && !clientGone {
+      log.Printf("Error reading %s stream: %v", target.Company, err)
+    }
+    if !clientGone {
+      if complete && format != nil && format.Done != "" {
+        w.WriteString("data: " + format.Done + "\n\n")
+      }
+      w.Flush()
+    }
+
+    // The provider only reports the final usage at the end of the stream
+    if !complete {
+      usage = partialUsage(usage, body, outputChars)
+    }
+    if err := recordStreamUsage(body.ID, target.Company, target.Model, keyLabel, usage, target.Price); err != nil {
+      log.Printf("%v", err)
+    }
+  })
+
+  return nil
+}
+
+// streamedChars counts the generated text and tool arguments of one event
+func streamedChars(streamer StreamProvider, data []byte) int {
+  var delta ChatDelta
+  if translator, ok := streamer.(OpenAITranslator); ok {
+    delta, _ = translator.TranslateEvent(data)
+  } else {
+    var chunk struct {
+      Choices []struct {
+        Delta ChatDelta `json:"delta"`
+      } `json:"choices"`
+    }
+    if json.Unmarshal(data, &chunk) != nil || len(chunk.Choices) == 0 {
+      return 0
+    }
+    delta = chunk.Choices[0].Delta
+  }
+
+  chars := len(delta.Content)
+  for _, call := range delta.ToolCalls {
+    chars += len(call.Function.Name) + len(call.Function.Arguments)
+  }
+  return chars
+}
+
+// partialUsage fills in the usage of a stream that was cut short, tokens the
+// provider hasn't reported yet are estimated like budget checks do
+func partialUsage(usage TokenUsage, body RequestBody, outputChars int) TokenUsage {
+  if usage.InputTokens == 0 && usage.CachedInputTokens == 0 {
+    usage.InputTokens = estimateInputTokens(body)
+  }
+  if estimated := (outputChars + 3) / 4; estimated > usage.OutputTokens {
+    usage.OutputTokens = estimated
+  }
+  return usage
+}
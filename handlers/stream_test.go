@@ -0,0 +1,98 @@
+package handlers
+
+import (
+  "context"
+  "io"
+  "net"
+  "net/http"
+  "testing"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+func TestRelayStreamCancelsUpstreamWhenClientLeaves(t *testing.T) {
+  upstreamDone := make(chan struct{})
+  newStandIn(t, testUpstreamConfig, func(w http.ResponseWriter, r *http.Request) {
+    defer close(upstreamDone)
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.WriteHeader(http.StatusOK)
+    for {
+      io.WriteString(w, `data: {"choices": [{"delta": {"content": "twelve chars"}}]}`+"\n\n")
+      w.(http.Flusher).Flush()
+      select {
+      case <-r.Context().Done():
+        return
+      case <-time.After(10 * time.Millisecond):
+      }
+    }
+  })
+
+  billed := make(chan TokenUsage, 1)
+  previous := recordStreamUsage
+  recordStreamUsage = func(userID string, company string, model string, keyLabel string, usage TokenUsage, price ModelPrice) error {
+    billed <- usage
+    return nil
+  }
+  t.Cleanup(func() { recordStreamUsage = previous })
+
+  prompt := "Count to a million"
+  body := RequestBody{ID: "user", Model: "gpt-4o", Prompt: &prompt}
+  app := fiber.New(fiber.Config{DisableStartupMessage: true})
+  app.Post("/stream", func(c *fiber.Ctx) error {
+    resp, err := OpenAIStream(context.Background(), testOpenAIBody())
+    if err != nil {
+      return err
+    }
+    return relayStream(c, openAIProvider{}, resp, body, completionTarget{Company: "openai", Model: "gpt-4o"}, "", nil)
+  })
+
+  listener, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go app.Listener(listener)
+  defer app.Shutdown()
+
+  client, err := net.Dial("tcp", listener.Addr().String())
+  if err != nil {
+    t.Fatal(err)
+  }
+  client.Write([]byte("POST /stream HTTP/1.1\r\nHost: test\r\nContent-Length: 0\r\n\r\n"))
+  client.Read(make([]byte, 1024))
+  client.Close()
+
+  select {
+  case <-upstreamDone:
+  case <-time.After(3 * time.Second):
+    t.Fatal("the upstream stream wasn't cancelled after the client hung up")
+  }
+  select {
+  case usage := <-billed:
+    if usage.InputTokens == 0 || usage.OutputTokens == 0 {
+      t.Errorf("got usage %+v, want estimated input and output tokens", usage)
+    }
+  case <-time.After(3 * time.Second):
+    t.Fatal("the partial stream wasn't billed")
+  }
+}
+
+func TestPartialUsage(t *testing.T) {
+  prompt := "12345678"
+  body := RequestBody{Prompt: &prompt}
+
+  usage := partialUsage(TokenUsage{}, body, 10)
+  if usage.InputTokens != estimateInputTokens(body) || usage.OutputTokens != 3 {
+    t.Errorf("nothing reported: got %+v", usage)
+  }
+
+  // Reported tokens are kept, output only grows to the estimate
+  usage = partialUsage(TokenUsage{InputTokens: 50, OutputTokens: 1}, body, 40)
+  if usage.InputTokens != 50 || usage.OutputTokens != 10 {
+    t.Errorf("partly reported: got %+v", usage)
+  }
+  usage = partialUsage(TokenUsage{InputTokens: 50, OutputTokens: 20}, body, 40)
+  if usage.OutputTokens != 20 {
+    t.Errorf("reported output above the estimate: got %+v", usage)
+  }
+}
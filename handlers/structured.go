@@ -0,0 +1,170 @@
+package handlers
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "regexp"
+  "strconv"
+  "strings"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// Most times an invalid output is sent back to the model to be fixed
+const maxOutputRepairs = 5
+
+var schemaNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// OutputSchema asks for a JSON document matching a JSON Schema
+type OutputSchema struct {
+  // Name identifies the schema to the model, it defaults to "response"
+  Name string `json:"name,omitempty"`
+  Schema json.RawMessage `json:"schema"`
+  // Repairs is how many times an invalid output is sent back to be fixed
+  Repairs int `json:"repairs,omitempty"`
+}
+
+func (schema OutputSchema) name() string {
+  if schema.Name == "" {
+    return "response"
+  }
+  return schema.Name
+}
+
+// StructuredProvider is implemented by providers that can return outputs
+// matching an output_schema
+type StructuredProvider interface {
+  // StructuredOutput returns the JSON document of a response
+  StructuredOutput(response []byte) (string, error)
+}
+
+// validateOutputSchema checks the schema before anything is sent upstream
+func validateOutputSchema(body RequestBody) error {
+  schema := body.OutputSchema
+  if schema == nil {
+    return nil
+  }
+  if !schemaNamePattern.MatchString(schema.name()) {
+    return errors.New("output_schema.name may only use letters, digits, _ and -, up to 64 characters")
+  }
+  if schema.Repairs < 0 || schema.Repairs > maxOutputRepairs {
+    return fmt.Errorf("output_schema.repairs must be between 0 and %d", maxOutputRepairs)
+  }
+  if len(body.Tools) > 0 {
+    return errors.New("output_schema can't be combined with tools")
+  }
+  // Outputs are validated once complete, which a stream never waits for
+  if body.Stream != nil && *body.Stream {
+    return errors.New("output_schema can't be combined with stream")
+  }
+
+  // Every provider needs an object at the root
+  var root struct {
+    Type string `json:"type"`
+  }
+  if err := json.Unmarshal(schema.Schema, &root); err != nil || root.Type != "object" {
+    return errors.New("output_schema.schema must be a JSON Schema of type object")
+  }
+  return nil
+}
+
+// repairRequest continues the conversation with the invalid output and its
+// problems, prompt requests are turned into messages first
+func repairRequest(body RequestBody, output string, problems []string) RequestBody {
+  messages := append([]Message(nil), body.Messages...)
+  if len(messages) == 0 && body.Prompt != nil {
+    systemPrompt := "You are a helpful assistant."
+    if body.SystemPrompt != nil {
+      systemPrompt = *body.SystemPrompt
+    }
+    messages = []Message{
+      {Role: "system", Content: TextContent(systemPrompt)},
+      {Role: "user", Content: TextContent(*body.Prompt)},
+    }
+  }
+
+  // Providers reject empty messages
+  if blank(output) {
+    output = "(no output)"
+  }
+  feedback := "Your answer does not match the JSON Schema:\n- " + strings.Join(problems, "\n- ") + "\nReply with the corrected JSON only."
+  body.Messages = append(messages,
+    Message{Role: "assistant", Content: TextContent(output)},
+    Message{Role: "user", Content: TextContent(feedback)},
+  )
+  body.Prompt = nil
+  body.SystemPrompt = nil
+  return body
+}
+
+// outputProblems lists why a response doesn't match the schema
+func outputProblems(provider Provider, schema OutputSchema, response []byte) (string, []string) {
+  structured, ok := provider.(StructuredProvider)
+  if !ok {
+    return "", nil
+  }
+  output, err := structured.StructuredOutput(response)
+  if err != nil {
+    return output, []string{err.Error()}
+  }
+  return output, validateJSONSchema(schema.Schema, output)
+}
+
+// enforceOutputSchema validates a successful response against the request's
+// output_schema and re-prompts the model up to output_schema.repairs times,
+// billing every attempt. Like enforceBudget, it reports whether it already
+// responded: when a repair call fails or the output stays invalid.
+func enforceOutputSchema(c *fiber.Ctx, provider Provider, target completionTarget, body RequestBody, response []byte) ([]byte, bool, error) {
+  schema := *body.OutputSchema
+  for repairs := 0; ; repairs++ {
+    output, problems := outputProblems(provider, schema, response)
+    c.Set("X-Output-Repairs", strconv.Itoa(repairs))
+    if len(problems) == 0 {
+      return response, false, nil
+    }
+
+    if repairs == schema.Repairs {
+      return nil, true, c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+        "error": "Output does not match output_schema: " + strings.Join(problems, "; "),
+        "response": json.RawMessage(response),
+      })
+    }
+
+    body = repairRequest(body, output, problems)
+    payload, err := provider.BuildRequest(body)
+    if err != nil {
+      return nil, true, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+        "error": err.Error(),
+      })
+    }
+
+    ctx, tracker := withKeyTracker(requestContext(c))
+    var statusCode int
+    response, statusCode, err = provider.Call(ctx, payload)
+    breakerReport(target.Company, target.Model, statusCode, err)
+    if err != nil {
+      return nil, true, c.Status(statusCode).JSON(fiber.Map{
+        "error": err.Error(),
+      })
+    }
+    if statusCode != http.StatusOK {
+      return nil, true, c.Status(statusCode).Send(response)
+    }
+
+    usage, err := provider.ParseUsage(response)
+    if err != nil {
+      return nil, true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+        "error": "Error parsing response JSON",
+      })
+    }
+    if err := recordUsage(body.ID, target.Company, target.Model, tracker.Label(), usage, target.Price); err != nil {
+      log.Printf("%v", err)
+      return nil, true, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+        "error": "Error updating MongoDB",
+      })
+    }
+  }
+}
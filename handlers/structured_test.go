@@ -0,0 +1,55 @@
+package handlers
+
+import (
+  "encoding/json"
+  "testing"
+)
+
+func TestValidateOutputSchema(t *testing.T) {
+  object := json.RawMessage(`{"type": "object", "properties": {"name": {"type": "string"}}}`)
+  streaming, notStreaming := true, false
+  tests := []struct {
+    name string
+    body RequestBody
+    valid bool
+  }{
+    {"no schema", RequestBody{Stream: &streaming}, true},
+    {"object", RequestBody{OutputSchema: &OutputSchema{Schema: object}}, true},
+    {"stream false", RequestBody{Stream: &notStreaming, OutputSchema: &OutputSchema{Schema: object}}, true},
+    {"stream", RequestBody{Stream: &streaming, OutputSchema: &OutputSchema{Schema: object}}, false},
+    {"tools", RequestBody{Tools: []Tool{{Type: "function"}}, OutputSchema: &OutputSchema{Schema: object}}, false},
+    {"array root", RequestBody{OutputSchema: &OutputSchema{Schema: json.RawMessage(`{"type": "array"}`)}}, false},
+    {"bad name", RequestBody{OutputSchema: &OutputSchema{Name: "a b", Schema: object}}, false},
+    {"too many repairs", RequestBody{OutputSchema: &OutputSchema{Schema: object, Repairs: maxOutputRepairs + 1}}, false},
+  }
+  for _, test := range tests {
+    err := validateOutputSchema(test.body)
+    if (err == nil) != test.valid {
+      t.Errorf("%s: got error %v, want valid %v", test.name, err, test.valid)
+    }
+  }
+}
+
+func TestGeminiResponseSchema(t *testing.T) {
+  prompt := "Extract the address"
+  schema := json.RawMessage(`{"$defs": {"zip": {"type": "string", "pattern": "^[0-9]{5}$"}}, "type": "object", "properties": {"zip": {"$ref": "#/$defs/zip"}, "kind": {"const": "home"}, "unit": {"oneOf": [{"type": "integer"}, {"type": "null"}]}}, "required": ["zip", "kind", "unit"], "additionalProperties": false}`)
+  body := RequestBody{Model: "gemini-1.5-flash", Prompt: &prompt, OutputSchema: &OutputSchema{Schema: schema}}
+
+  payload, err := googleProvider{}.BuildRequest(body)
+  if err != nil {
+    t.Fatalf("BuildRequest: %v", err)
+  }
+  config := payload.(GRequestBody).GenerationConfig
+  if config == nil || config.ResponseMIMEType != "application/json" {
+    t.Fatalf("got generation config %+v, want a JSON response", config)
+  }
+  want := `{"type": "object", "properties": {"zip": {"type": "string"}, "kind": {"type": "string", "enum": ["home"]}, "unit": {"type": "integer", "nullable": true}}, "required": ["zip", "kind", "unit"]}`
+  if !sameJSON(t, config.ResponseSchema, want) {
+    t.Fatalf("got response_schema %s, want %s", config.ResponseSchema, want)
+  }
+
+  // The full schema is still the one outputs are validated against
+  if problems := validateJSONSchema(body.OutputSchema.Schema, `{"zip": "1234", "kind": "home", "unit": null}`); len(problems) != 1 {
+    t.Fatalf("got problems %v, want the zip pattern to be checked", problems)
+  }
+}
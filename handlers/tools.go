@@ -0,0 +1,285 @@
+package handlers
+
+import (
+  "bytes"
+  "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+)
+
+// Tool is an OpenAI style function the model may call
+type Tool struct {
+  Type string `json:"type"`
+  Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+  Name string `json:"name"`
+  Description string `json:"description,omitempty"`
+  // Parameters is the JSON Schema of the arguments
+  Parameters json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is a function call requested by the model. Index is only set on
+// streamed deltas.
+type ToolCall struct {
+  Index *int `json:"index,omitempty"`
+  ID string `json:"id,omitempty"`
+  Type string `json:"type,omitempty"`
+  Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+  Name string `json:"name,omitempty"`
+  // Arguments is a JSON object encoded as a string
+  Arguments string `json:"arguments,omitempty"`
+}
+
+// ToolChoice is OpenAI's tool_choice: "auto", "none", "required" or
+// {"type": "function", "function": {"name": ...}}
+type ToolChoice struct {
+  // Mode is auto, none, required or function
+  Mode string
+  Function string
+}
+
+func (choice *ToolChoice) UnmarshalJSON(data []byte) error {
+  var mode string
+  if err := json.Unmarshal(data, &mode); err == nil {
+    switch mode {
+    case "auto", "none", "required":
+      choice.Mode = mode
+      return nil
+    }
+    return fmt.Errorf("tool_choice must be auto, none, required or a function")
+  }
+
+  var named struct {
+    Type string `json:"type"`
+    Function struct {
+      Name string `json:"name"`
+    } `json:"function"`
+  }
+  if err := json.Unmarshal(data, &named); err != nil || named.Type != "function" || named.Function.Name == "" {
+    return fmt.Errorf("tool_choice must be auto, none, required or a function")
+  }
+  choice.Mode = "function"
+  choice.Function = named.Function.Name
+  return nil
+}
+
+func (choice ToolChoice) MarshalJSON() ([]byte, error) {
+  if choice.Mode != "function" {
+    return json.Marshal(choice.Mode)
+  }
+  return json.Marshal(map[string]interface{}{
+    "type": "function",
+    "function": map[string]string{"name": choice.Function},
+  })
+}
+
+// validateTools checks the tools and that every tool message answers a call
+// made earlier in the conversation
+func validateTools(body RequestBody) error {
+  names := map[string]bool{}
+  for _, tool := range body.Tools {
+    if tool.Type != "function" {
+      return errors.New("only function tools are supported")
+    }
+    if tool.Function.Name == "" {
+      return errors.New("every tool needs a function name")
+    }
+    names[tool.Function.Name] = true
+  }
+
+  if body.ToolChoice != nil && body.ToolChoice.Mode == "function" && !names[body.ToolChoice.Function] {
+    return fmt.Errorf("tool_choice names unknown function %s", body.ToolChoice.Function)
+  }
+
+  calls := map[string]bool{}
+  for _, msg := range body.Messages {
+    for _, call := range msg.ToolCalls {
+      if call.ID == "" || call.Function.Name == "" {
+        return errors.New("tool_calls need an id and a function name")
+      }
+      if _, err := toolArguments(call); err != nil {
+        return err
+      }
+      calls[call.ID] = true
+    }
+    if msg.Role == "tool" && !calls[msg.ToolCallID] {
+      return fmt.Errorf("tool message answers unknown tool_call_id %q", msg.ToolCallID)
+    }
+  }
+  return nil
+}
+
+// toolArguments returns the call's arguments as a JSON object
+func toolArguments(call ToolCall) (json.RawMessage, error) {
+  arguments := bytes.TrimSpace([]byte(call.Function.Arguments))
+  if len(arguments) == 0 {
+    return json.RawMessage("{}"), nil
+  }
+  if arguments[0] != '{' || !json.Valid(arguments) {
+    return nil, fmt.Errorf("arguments of tool call %s must be a JSON object", call.ID)
+  }
+  return json.RawMessage(arguments), nil
+}
+
+// toolCallNames maps call IDs to function names, Gemini answers calls by name
+func toolCallNames(messages []Message) map[string]string {
+  names := map[string]string{}
+  for _, msg := range messages {
+    for _, call := range msg.ToolCalls {
+      names[call.ID] = call.Function.Name
+    }
+  }
+  return names
+}
+
+// Gemini has no call IDs, so one is made up for each call it returns
+func newToolCallID() string {
+  id := make([]byte, 12)
+  rand.Read(id)
+  return "call_" + hex.EncodeToString(id)
+}
+
+func geminiTools(body RequestBody) ([]GTool, *GToolConfig) {
+  if len(body.Tools) == 0 {
+    return nil, nil
+  }
+
+  declarations := make([]GFunctionDeclaration, len(body.Tools))
+  for i, tool := range body.Tools {
+    declarations[i] = GFunctionDeclaration{
+      Name: tool.Function.Name,
+      Description: tool.Function.Description,
+      Parameters: geminiSchema(tool.Function.Parameters),
+    }
+  }
+
+  var config *GToolConfig
+  if body.ToolChoice != nil {
+    config = &GToolConfig{}
+    switch body.ToolChoice.Mode {
+    case "none":
+      config.FunctionCallingConfig.Mode = "NONE"
+    case "required":
+      config.FunctionCallingConfig.Mode = "ANY"
+    case "function":
+      config.FunctionCallingConfig.Mode = "ANY"
+      config.FunctionCallingConfig.AllowedFunctionNames = []string{body.ToolChoice.Function}
+    default:
+      config.FunctionCallingConfig.Mode = "AUTO"
+    }
+  }
+  return []GTool{{FunctionDeclarations: declarations}}, config
+}
+
+// geminiParts converts a message into parts: text and images, functionCall parts for an
+// assistant's tool calls or a functionResponse part for a tool message
+func geminiParts(msg Message, callNames map[string]string) []Part {
+  if msg.Role == "tool" {
+    // The response has to be an object, plain results are wrapped
+    text := msg.Content.Text()
+    response := json.RawMessage(bytes.TrimSpace([]byte(text)))
+    if len(response) == 0 || response[0] != '{' || !json.Valid(response) {
+      response, _ = json.Marshal(map[string]string{"content": text})
+    }
+    return []Part{{FunctionResponse: &FunctionResponse{Name: callNames[msg.ToolCallID], Response: response}}}
+  }
+
+  parts := geminiContentParts(msg.Content)
+  for _, call := range msg.ToolCalls {
+    arguments, _ := toolArguments(call)
+    parts = append(parts, Part{FunctionCall: &FunctionCall{Name: call.Function.Name, Args: arguments}})
+  }
+  return parts
+}
+
+// geminiToolCalls normalises the functionCall parts of a candidate
+func geminiToolCalls(parts []Part) []ToolCall {
+  var calls []ToolCall
+  for _, part := range parts {
+    if part.FunctionCall == nil {
+      continue
+    }
+    arguments := string(part.FunctionCall.Args)
+    if arguments == "" {
+      arguments = "{}"
+    }
+    calls = append(calls, ToolCall{
+      ID: newToolCallID(),
+      Type: "function",
+      Function: ToolCallFunction{Name: part.FunctionCall.Name, Arguments: arguments},
+    })
+  }
+  return calls
+}
+
+func anthropicTools(body RequestBody) ([]ANTTool, *ANTToolChoice) {
+  if len(body.Tools) == 0 {
+    return nil, nil
+  }
+
+  tools := make([]ANTTool, len(body.Tools))
+  for i, tool := range body.Tools {
+    schema := tool.Function.Parameters
+    if len(schema) == 0 {
+      schema = json.RawMessage(`{"type":"object","properties":{}}`)
+    }
+    tools[i] = ANTTool{Name: tool.Function.Name, Description: tool.Function.Description, InputSchema: schema}
+  }
+
+  var choice *ANTToolChoice
+  if body.ToolChoice != nil {
+    switch body.ToolChoice.Mode {
+    case "none":
+      choice = &ANTToolChoice{Type: "none"}
+    case "required":
+      choice = &ANTToolChoice{Type: "any"}
+    case "function":
+      choice = &ANTToolChoice{Type: "tool", Name: body.ToolChoice.Function}
+    default:
+      choice = &ANTToolChoice{Type: "auto"}
+    }
+  }
+  return tools, choice
+}
+
+// anthropicBlocks converts a message into content blocks: text and images, tool_use
+// blocks for an assistant's tool calls or a tool_result for a tool message
+func anthropicBlocks(msg Message) []ANTBlock {
+  if msg.Role == "tool" {
+    return []ANTBlock{{Type: "tool_result", ToolUseID: msg.ToolCallID, Content: msg.Content.Text()}}
+  }
+
+  blocks := anthropicContentBlocks(msg.Content)
+  for _, call := range msg.ToolCalls {
+    arguments, _ := toolArguments(call)
+    blocks = append(blocks, ANTBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: arguments})
+  }
+  return blocks
+}
+
+// anthropicToolCalls normalises the tool_use blocks of a response
+func anthropicToolCalls(blocks []ANTBlock) []ToolCall {
+  var calls []ToolCall
+  for _, block := range blocks {
+    if block.Type != "tool_use" {
+      continue
+    }
+    arguments := string(block.Input)
+    if arguments == "" {
+      arguments = "{}"
+    }
+    calls = append(calls, ToolCall{
+      ID: block.ID,
+      Type: "function",
+      Function: ToolCallFunction{Name: block.Name, Arguments: arguments},
+    })
+  }
+  return calls
+}
@@ -0,0 +1,347 @@
+package handlers
+
+import (
+  "context"
+  "errors"
+  "io"
+  "io/ioutil"
+  "log"
+  "math/rand"
+  "net/http"
+  "net/url"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// upstreamConfig controls how one provider's API is called
+type upstreamConfig struct {
+  // Timeout bounds a whole call, or only the wait for headers when streaming
+  Timeout time.Duration
+  // IdleTimeout bounds the wait for each read of a stream, 0 disables it
+  IdleTimeout time.Duration
+  // MaxRetries is the number of attempts after the first one
+  MaxRetries int
+  BaseDelay time.Duration
+  MaxDelay time.Duration
+  // MaxRetryAfter is the longest server requested wait we honour, longer
+  // waits return the response so the caller can fall back instead
+  MaxRetryAfter time.Duration
+}
+
+var defaultUpstreamConfig = upstreamConfig{
+  Timeout: 120 * time.Second,
+  IdleTimeout: 60 * time.Second,
+  MaxRetries: 2,
+  BaseDelay: 500 * time.Millisecond,
+  MaxDelay: 8 * time.Second,
+  MaxRetryAfter: 30 * time.Second,
+}
+
+// Long completions from Claude can take several minutes
+var upstreamConfigs = map[string]upstreamConfig{
+  "anthropic": {
+    Timeout: 300 * time.Second,
+    IdleTimeout: 60 * time.Second,
+    MaxRetries: 2,
+    BaseDelay: 500 * time.Millisecond,
+    MaxDelay: 8 * time.Second,
+    MaxRetryAfter: 30 * time.Second,
+  },
+}
+
+// statusClientClosed is nginx's status for a request the client abandoned
+const statusClientClosed = 499
+
+// Base URLs can be overridden to use a proxy or a stand-in provider
+var upstreamBaseURLs = map[string]string{
+  "openai": "https://api.openai.com",
+  "google": "https://generativelanguage.googleapis.com",
+  "anthropic": "https://api.anthropic.com",
+}
+
+var upstreamBaseURLEnvs = map[string]string{
+  "openai": "OPENAI_BASE_URL",
+  "google": "GEMINI_BASE_URL",
+  "anthropic": "ANTHROPIC_BASE_URL",
+}
+
+var upstreamClient = &http.Client{
+  Transport: &http.Transport{
+    Proxy: http.ProxyFromEnvironment,
+    MaxIdleConnsPerHost: 32,
+    IdleConnTimeout: 90 * time.Second,
+    TLSHandshakeTimeout: 10 * time.Second,
+  },
+}
+
+// getUpstreamConfig applies the UPSTREAM_TIMEOUT_<COMPANY> and
+// UPSTREAM_IDLE_TIMEOUT_<COMPANY> overrides, e.g. UPSTREAM_TIMEOUT_OPENAI=60s
+func getUpstreamConfig(company string) upstreamConfig {
+  config, ok := upstreamConfigs[company]
+  if !ok {
+    config = defaultUpstreamConfig
+  }
+
+  overrides := map[string]*time.Duration{
+    "UPSTREAM_TIMEOUT_": &config.Timeout,
+    "UPSTREAM_IDLE_TIMEOUT_": &config.IdleTimeout,
+  }
+  for prefix, setting := range overrides {
+    name := prefix + strings.ToUpper(company)
+    if value := os.Getenv(name); value != "" {
+      if timeout, err := time.ParseDuration(value); err == nil {
+        *setting = timeout
+      } else {
+        log.Printf("Invalid %s: %v", name, err)
+      }
+    }
+  }
+  return config
+}
+
+func upstreamURL(company string, path string) string {
+  base := upstreamBaseURLs[company]
+  if override := os.Getenv(upstreamBaseURLEnvs[company]); override != "" {
+    base = strings.TrimSuffix(override, "/")
+  }
+  return base + path
+}
+
+// upstreamCall sends the request with retries and reads the whole response
+func upstreamCall(ctx context.Context, company string, req *http.Request) ([]byte, int, error) {
+  config := getUpstreamConfig(company)
+  ctx, cancel := context.WithTimeout(ctx, config.Timeout)
+  defer cancel()
+
+  resp, err := upstreamDo(ctx, company, config, req)
+  if err != nil {
+    if errors.Is(err, context.DeadlineExceeded) {
+      return nil, http.StatusGatewayTimeout, fiber.NewError(fiber.StatusGatewayTimeout, "Upstream request timed out")
+    }
+    if errors.Is(err, context.Canceled) {
+      return nil, statusClientClosed, fiber.NewError(statusClientClosed, "Client closed the request")
+    }
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error sending request")
+  }
+  defer resp.Body.Close()
+
+  // Read response
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error reading response")
+  }
+
+  return body, resp.StatusCode, nil
+}
+
+// upstreamStream sends the request with retries and returns the open response,
+// the timeout only covers the wait for the response headers
+func upstreamStream(ctx context.Context, company string, req *http.Request) (*http.Response, error) {
+  config := getUpstreamConfig(company)
+  headersCtx, cancel := context.WithCancel(ctx)
+  timer := time.AfterFunc(config.Timeout, cancel)
+
+  resp, err := upstreamDo(headersCtx, company, config, req)
+  if err != nil || !timer.Stop() {
+    cancel()
+    if resp != nil {
+      resp.Body.Close()
+    }
+    if err == nil || errors.Is(err, context.Canceled) && ctx.Err() == nil {
+      return nil, fiber.NewError(fiber.StatusGatewayTimeout, "Upstream request timed out")
+    }
+    return nil, fiber.NewError(fiber.StatusInternalServerError, "Error sending request")
+  }
+
+  // The context has to outlive this function while the body is read
+  body := &streamBody{ReadCloser: resp.Body, cancel: cancel, idle: config.IdleTimeout}
+  if body.idle > 0 {
+    body.timer = time.AfterFunc(body.idle, cancel)
+  }
+  resp.Body = body
+  return resp, nil
+}
+
+var errStreamIdle = errors.New("upstream stream stalled")
+
+// streamBody cancels the request once it is closed or when a single read
+// waits longer than the idle timeout
+type streamBody struct {
+  io.ReadCloser
+  cancel context.CancelFunc
+  idle time.Duration
+  timer *time.Timer
+}
+
+func (body *streamBody) Read(p []byte) (int, error) {
+  if body.timer == nil {
+    return body.ReadCloser.Read(p)
+  }
+  body.timer.Reset(body.idle)
+  n, err := body.ReadCloser.Read(p)
+  if !body.timer.Stop() && err != nil && err != io.EOF {
+    err = errStreamIdle
+  }
+  return n, err
+}
+
+func (body *streamBody) Close() error {
+  if body.timer != nil {
+    body.timer.Stop()
+  }
+  err := body.ReadCloser.Close()
+  body.cancel()
+  return err
+}
+
+// upstreamDo makes the request with a key from the company's pool, retrying
+// network errors and retryable status codes with jittered exponential backoff
+// or the server's requested delay
+func upstreamDo(ctx context.Context, company string, config upstreamConfig, req *http.Request) (*http.Response, error) {
+  pool := getKeyPool(company)
+  keyed, _ := providers[company].(KeyedProvider)
+
+  for attempt := 0; ; attempt++ {
+    attemptReq := req.Clone(ctx)
+    if req.GetBody != nil {
+      body, err := req.GetBody()
+      if err != nil {
+        return nil, err
+      }
+      attemptReq.Body = body
+    }
+
+    key := pool.acquire()
+    if key != nil && keyed != nil {
+      keyed.Authorize(attemptReq, key.Secret)
+      trackKey(ctx, key.Label)
+    }
+
+    resp, err := upstreamClient.Do(attemptReq)
+    var hinted time.Duration
+    hintFound := false
+    if resp != nil {
+      hinted, hintFound = retryAfter(resp.Header)
+    }
+    pool.release(key, statusOf(resp), hinted)
+
+    if err != nil && ctx.Err() != nil {
+      return nil, ctx.Err()
+    }
+    // A rejected key is worth retrying only when the pool has another one
+    rejectedKey := resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) && pool.available()
+    if err == nil && !retryableStatus(resp.StatusCode) && !rejectedKey || attempt >= config.MaxRetries {
+      return resp, err
+    }
+
+    delay := backoffDelay(config, attempt)
+    if resp != nil {
+      if (resp.StatusCode == http.StatusTooManyRequests || rejectedKey) && pool.available() {
+        // Another key can take the request right away
+        delay = 0
+      } else if hintFound {
+        // Let the caller fall back rather than hold the client for minutes
+        if hinted > config.MaxRetryAfter {
+          return resp, nil
+        }
+        delay = hinted + time.Duration(rand.Int63n(int64(100*time.Millisecond)))
+      }
+      io.Copy(ioutil.Discard, resp.Body)
+      resp.Body.Close()
+      log.Printf("%s answered %d, retrying in %v", company, resp.StatusCode, delay)
+    } else {
+      // Gemini carries the key in the URL, so only log the cause
+      var urlErr *url.Error
+      if errors.As(err, &urlErr) {
+        err = urlErr.Err
+      }
+      log.Printf("%s request failed: %v, retrying in %v", company, err, delay)
+    }
+
+    select {
+    case <-time.After(delay):
+    case <-ctx.Done():
+      return nil, ctx.Err()
+    }
+  }
+}
+
+func retryableStatus(statusCode int) bool {
+  switch statusCode {
+  case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, 529:
+    return true
+  }
+  return false
+}
+
+// Full jitter: a random delay up to BaseDelay * 2^attempt, capped at MaxDelay
+func backoffDelay(config upstreamConfig, attempt int) time.Duration {
+  ceiling := config.BaseDelay << attempt
+  if ceiling <= 0 || ceiling > config.MaxDelay {
+    ceiling = config.MaxDelay
+  }
+  return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// retryAfter reads Retry-After, or else the reset time of any exhausted
+// x-ratelimit-* / anthropic-ratelimit-* limit
+func retryAfter(header http.Header) (time.Duration, bool) {
+  if value := header.Get("Retry-After"); value != "" {
+    if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+      return time.Duration(seconds * float64(time.Second)), true
+    }
+    if date, err := http.ParseTime(value); err == nil {
+      return max(time.Until(date), 0), true
+    }
+  }
+
+  var longest time.Duration
+  found := false
+  for name, values := range header {
+    lower := strings.ToLower(name)
+    var kind, prefix string
+    switch {
+    case strings.HasPrefix(lower, "x-ratelimit-reset-"):
+      prefix, kind = "x-ratelimit-", strings.TrimPrefix(lower, "x-ratelimit-reset-")
+    case strings.HasPrefix(lower, "anthropic-ratelimit-") && strings.HasSuffix(lower, "-reset"):
+      prefix, kind = "anthropic-ratelimit-", strings.TrimSuffix(strings.TrimPrefix(lower, "anthropic-ratelimit-"), "-reset")
+    default:
+      continue
+    }
+
+    // Only limits that are used up explain the 429
+    var remaining string
+    if prefix == "x-ratelimit-" {
+      remaining = header.Get(prefix + "remaining-" + kind)
+    } else {
+      remaining = header.Get(prefix + kind + "-remaining")
+    }
+    if remaining != "0" || len(values) == 0 {
+      continue
+    }
+
+    if wait, ok := parseReset(values[0]); ok && wait > longest {
+      longest = wait
+      found = true
+    }
+  }
+  return longest, found
+}
+
+// Resets come as durations ("6m0s"), RFC 3339 dates or seconds
+func parseReset(value string) (time.Duration, bool) {
+  if wait, err := time.ParseDuration(value); err == nil {
+    return wait, true
+  }
+  if date, err := time.Parse(time.RFC3339, value); err == nil {
+    return max(time.Until(date), 0), true
+  }
+  if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+    return time.Duration(seconds * float64(time.Second)), true
+  }
+  return 0, false
+}
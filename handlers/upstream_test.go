@@ -0,0 +1,380 @@
+package handlers
+
+import (
+  "context"
+  "errors"
+  "io"
+  "io/ioutil"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/gofiber/fiber/v2"
+)
+
+// standIn is an OpenAI stand-in that answers with the given handlers in turn
+// and records the requests it received
+type standIn struct {
+  mu sync.Mutex
+  bodies []string
+  times []time.Time
+  auth []string
+}
+
+func (s *standIn) hits() int {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  return len(s.bodies)
+}
+
+func newStandIn(t *testing.T, config upstreamConfig, answers ...http.HandlerFunc) *standIn {
+  t.Helper()
+  s := &standIn{}
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    body, _ := ioutil.ReadAll(r.Body)
+    s.mu.Lock()
+    s.bodies = append(s.bodies, string(body))
+    s.times = append(s.times, time.Now())
+    s.auth = append(s.auth, r.Header.Get("Authorization"))
+    attempt := len(s.bodies) - 1
+    s.mu.Unlock()
+
+    if attempt >= len(answers) {
+      attempt = len(answers) - 1
+    }
+    answers[attempt](w, r)
+  }))
+  t.Cleanup(server.Close)
+
+  t.Setenv("OPENAI_BASE_URL", server.URL)
+  t.Setenv("OPENAI_API_KEY", "sk-test")
+  t.Setenv("OPENAI_API_KEYS", "")
+  t.Setenv("UPSTREAM_TIMEOUT_OPENAI", "")
+  t.Setenv("UPSTREAM_IDLE_TIMEOUT_OPENAI", "")
+
+  previous, hadPrevious := upstreamConfigs["openai"]
+  upstreamConfigs["openai"] = config
+  resetKeyPool("openai")
+  t.Cleanup(func() {
+    if hadPrevious {
+      upstreamConfigs["openai"] = previous
+    } else {
+      delete(upstreamConfigs, "openai")
+    }
+    resetKeyPool("openai")
+  })
+  return s
+}
+
+func resetKeyPool(company string) {
+  keyPoolsMu.Lock()
+  defer keyPoolsMu.Unlock()
+  delete(keyPools, company)
+}
+
+func answer(status int, headers map[string]string) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    for name, value := range headers {
+      w.Header().Set(name, value)
+    }
+    w.WriteHeader(status)
+    io.WriteString(w, `{"status":"`+http.StatusText(status)+`"}`)
+  }
+}
+
+var testUpstreamConfig = upstreamConfig{
+  Timeout: 2 * time.Second,
+  MaxRetries: 2,
+  BaseDelay: time.Millisecond,
+  MaxDelay: 5 * time.Millisecond,
+  MaxRetryAfter: time.Second,
+}
+
+func testOpenAIBody() OAIRequestBody {
+  return OAIRequestBody{Model: "gpt-4o", Messages: []OAIMessage{{Role: "user", Content: TextContent("Hi")}}}
+}
+
+func TestUpstreamRetriesRetryableStatus(t *testing.T) {
+  for _, status := range []int{429, 500, 502, 503, 529} {
+    t.Run(http.StatusText(status), func(t *testing.T) {
+      s := newStandIn(t, testUpstreamConfig, answer(status, nil), answer(http.StatusOK, nil))
+
+      _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody())
+      if err != nil {
+        t.Fatalf("unexpected error: %v", err)
+      }
+      if statusCode != http.StatusOK {
+        t.Errorf("status = %d, want 200", statusCode)
+      }
+      if s.hits() != 2 {
+        t.Errorf("upstream got %d requests, want 2", s.hits())
+      }
+    })
+  }
+}
+
+func TestUpstreamDoesNotRetryClientErrors(t *testing.T) {
+  s := newStandIn(t, testUpstreamConfig, answer(http.StatusBadRequest, nil), answer(http.StatusOK, nil))
+
+  _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody())
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if statusCode != http.StatusBadRequest || s.hits() != 1 {
+    t.Errorf("got status %d after %d requests, want 400 after 1", statusCode, s.hits())
+  }
+}
+
+func TestUpstreamStopsAfterMaxRetries(t *testing.T) {
+  s := newStandIn(t, testUpstreamConfig, answer(http.StatusServiceUnavailable, nil))
+
+  _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody())
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if statusCode != http.StatusServiceUnavailable || s.hits() != 3 {
+    t.Errorf("got status %d after %d requests, want 503 after 3", statusCode, s.hits())
+  }
+}
+
+func TestUpstreamReplaysBodyOnRetry(t *testing.T) {
+  s := newStandIn(t, testUpstreamConfig, answer(http.StatusBadGateway, nil), answer(http.StatusOK, nil))
+
+  if _, _, err := OpenAIResponseJSON(context.Background(), testOpenAIBody()); err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if s.hits() != 2 {
+    t.Fatalf("upstream got %d requests, want 2", s.hits())
+  }
+  if s.bodies[0] == "" || s.bodies[0] != s.bodies[1] {
+    t.Errorf("retry sent %q, first attempt sent %q", s.bodies[1], s.bodies[0])
+  }
+  for i, auth := range s.auth {
+    if auth != "Bearer sk-test" {
+      t.Errorf("attempt %d sent Authorization %q", i, auth)
+    }
+  }
+}
+
+func TestUpstreamHonoursRetryAfter(t *testing.T) {
+  tests := []struct {
+    name string
+    headers map[string]string
+  }{
+    {"retry-after", map[string]string{"Retry-After": "0.2"}},
+    {"x-ratelimit-reset", map[string]string{"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "200ms"}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      s := newStandIn(t, testUpstreamConfig, answer(http.StatusServiceUnavailable, test.headers), answer(http.StatusOK, nil))
+
+      _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody())
+      if err != nil || statusCode != http.StatusOK {
+        t.Fatalf("got status %d, error %v", statusCode, err)
+      }
+      if s.hits() != 2 {
+        t.Fatalf("upstream got %d requests, want 2", s.hits())
+      }
+      if waited := s.times[1].Sub(s.times[0]); waited < 200*time.Millisecond {
+        t.Errorf("retried after %v, want at least 200ms", waited)
+      }
+    })
+  }
+}
+
+func TestUpstreamReturnsLongRetryAfter(t *testing.T) {
+  s := newStandIn(t, testUpstreamConfig, answer(http.StatusServiceUnavailable, map[string]string{"Retry-After": "60"}), answer(http.StatusOK, nil))
+
+  started := time.Now()
+  _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody())
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  if statusCode != http.StatusServiceUnavailable || s.hits() != 1 {
+    t.Errorf("got status %d after %d requests, want 503 after 1", statusCode, s.hits())
+  }
+  if elapsed := time.Since(started); elapsed > time.Second {
+    t.Errorf("returned after %v, want right away", elapsed)
+  }
+}
+
+func TestUpstreamCallTimesOut(t *testing.T) {
+  config := testUpstreamConfig
+  config.Timeout = 100 * time.Millisecond
+  release := make(chan struct{})
+  defer close(release)
+  newStandIn(t, config, func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-release:
+    case <-r.Context().Done():
+    }
+  })
+
+  _, statusCode, err := OpenAIResponseJSON(context.Background(), testOpenAIBody())
+  if statusCode != http.StatusGatewayTimeout || err == nil {
+    t.Errorf("got status %d, error %v, want 504", statusCode, err)
+  }
+}
+
+func TestRetryAfter(t *testing.T) {
+  tests := []struct {
+    name string
+    headers map[string]string
+    want time.Duration
+    found bool
+  }{
+    {"none", nil, 0, false},
+    {"seconds", map[string]string{"Retry-After": "2"}, 2 * time.Second, true},
+    {"fractional seconds", map[string]string{"Retry-After": "0.5"}, 500 * time.Millisecond, true},
+    {"openai reset", map[string]string{"x-ratelimit-remaining-tokens": "0", "x-ratelimit-reset-tokens": "6m0s"}, 6 * time.Minute, true},
+    {"openai reset not exhausted", map[string]string{"x-ratelimit-remaining-tokens": "10", "x-ratelimit-reset-tokens": "6m0s"}, 0, false},
+    {"longest exhausted reset", map[string]string{
+      "x-ratelimit-remaining-tokens": "0", "x-ratelimit-reset-tokens": "2s",
+      "x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "5s",
+    }, 5 * time.Second, true},
+    {"reset in seconds", map[string]string{"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "3"}, 3 * time.Second, true},
+    {"unparseable reset", map[string]string{"x-ratelimit-remaining-requests": "0", "x-ratelimit-reset-requests": "soon"}, 0, false},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      header := http.Header{}
+      for name, value := range test.headers {
+        header.Set(name, value)
+      }
+      got, found := retryAfter(header)
+      if got != test.want || found != test.found {
+        t.Errorf("retryAfter = %v, %v, want %v, %v", got, found, test.want, test.found)
+      }
+    })
+  }
+}
+
+func TestRetryAfterDates(t *testing.T) {
+  header := http.Header{}
+  header.Set("Retry-After", time.Now().Add(10*time.Second).UTC().Format(http.TimeFormat))
+  if wait, found := retryAfter(header); !found || wait < 8*time.Second || wait > 10*time.Second {
+    t.Errorf("HTTP date: retryAfter = %v, %v", wait, found)
+  }
+
+  header = http.Header{}
+  header.Set("anthropic-ratelimit-tokens-remaining", "0")
+  header.Set("anthropic-ratelimit-tokens-reset", time.Now().Add(20*time.Second).UTC().Format(time.RFC3339))
+  if wait, found := retryAfter(header); !found || wait < 18*time.Second || wait > 20*time.Second {
+    t.Errorf("anthropic reset: retryAfter = %v, %v", wait, found)
+  }
+
+  // A date in the past means the limit already reset
+  header = http.Header{}
+  header.Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+  if wait, found := retryAfter(header); !found || wait != 0 {
+    t.Errorf("past date: retryAfter = %v, %v", wait, found)
+  }
+}
+
+func TestUpstreamStreamTimesOutWaitingForHeaders(t *testing.T) {
+  config := testUpstreamConfig
+  config.Timeout = 100 * time.Millisecond
+  release := make(chan struct{})
+  defer close(release)
+  newStandIn(t, config, func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-release:
+    case <-r.Context().Done():
+    }
+  })
+
+  resp, err := OpenAIStream(context.Background(), testOpenAIBody())
+  if resp != nil {
+    resp.Body.Close()
+  }
+  var fiberErr *fiber.Error
+  if !errors.As(err, &fiberErr) || fiberErr.Code != fiber.StatusGatewayTimeout {
+    t.Errorf("got error %v, want a 504", err)
+  }
+}
+
+func TestUpstreamStreamOutlivesTimeoutOnceHeadersArrive(t *testing.T) {
+  config := testUpstreamConfig
+  config.Timeout = 100 * time.Millisecond
+  newStandIn(t, config, func(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.WriteHeader(http.StatusOK)
+    io.WriteString(w, "data: first\n\n")
+    w.(http.Flusher).Flush()
+    time.Sleep(300 * time.Millisecond)
+    io.WriteString(w, "data: [DONE]\n\n")
+  })
+
+  resp, err := OpenAIStream(context.Background(), testOpenAIBody())
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  if err != nil {
+    t.Fatalf("reading the stream failed: %v", err)
+  }
+  if !strings.Contains(string(body), "[DONE]") {
+    t.Errorf("stream was cut short: %q", body)
+  }
+}
+
+func TestUpstreamStreamCancelledByCaller(t *testing.T) {
+  release := make(chan struct{})
+  defer close(release)
+  newStandIn(t, testUpstreamConfig, func(w http.ResponseWriter, r *http.Request) {
+    select {
+    case <-release:
+    case <-r.Context().Done():
+    }
+  })
+
+  ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+  defer cancel()
+  resp, err := OpenAIStream(ctx, testOpenAIBody())
+  if resp != nil {
+    resp.Body.Close()
+  }
+  var fiberErr *fiber.Error
+  if !errors.As(err, &fiberErr) || fiberErr.Code != fiber.StatusInternalServerError {
+    t.Errorf("got error %v, want a 500", err)
+  }
+}
+
+func TestUpstreamStreamIdleTimeout(t *testing.T) {
+  config := testUpstreamConfig
+  config.IdleTimeout = 100 * time.Millisecond
+  upstreamDone := make(chan struct{})
+  newStandIn(t, config, func(w http.ResponseWriter, r *http.Request) {
+    defer close(upstreamDone)
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.WriteHeader(http.StatusOK)
+    io.WriteString(w, "data: first\n\n")
+    w.(http.Flusher).Flush()
+    select {
+    case <-r.Context().Done():
+    case <-time.After(5 * time.Second):
+    }
+  })
+
+  resp, err := OpenAIStream(context.Background(), testOpenAIBody())
+  if err != nil {
+    t.Fatalf("unexpected error: %v", err)
+  }
+  defer resp.Body.Close()
+  body, err := ioutil.ReadAll(resp.Body)
+  if !errors.Is(err, errStreamIdle) {
+    t.Errorf("got error %v, want the stream to stall", err)
+  }
+  if !strings.Contains(string(body), "first") {
+    t.Errorf("the data before the stall was lost: %q", body)
+  }
+  select {
+  case <-upstreamDone:
+  case <-time.After(2 * time.Second):
+    t.Fatal("the stalled upstream request wasn't cancelled")
+  }
+}
@@ -1,9 +1,249 @@
 package handlers
 
 import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "fmt"
+  "io"
+  "log"
+  "mime/multipart"
+  "net/http"
+  "strings"
+  "time"
+
   "github.com/gofiber/fiber/v2"
+  "go.mongodb.org/mongo-driver/bson"
+  "go.mongodb.org/mongo-driver/mongo/options"
 )
 
+type WhisperResponse struct {
+  Text string `json:"text"`
+  Language string `json:"language"`
+  Duration float64 `json:"duration"`
+  Segments []WhisperSegment `json:"segments"`
+}
+
+type WhisperSegment struct {
+  Start float64 `json:"start"`
+  End float64 `json:"end"`
+  Text string `json:"text"`
+}
+
+// WhisperResponseJSON always asks for verbose_json since it is the only
+// format that reports the audio duration needed for billing
+func WhisperResponseJSON(ctx context.Context, file *multipart.FileHeader, model string, language string) ([]byte, int, error) {
+  // Check the openai API keys and set the endpoint, the key is added per attempt
+  if !getKeyPool("openai").configured() {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "OPENAI_API_KEY is not set")
+  }
+  url := upstreamURL("openai", "/v1/audio/transcriptions")
+
+  // Open the uploaded audio
+  audio, err := file.Open()
+  if err != nil {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error reading audio file")
+  }
+  defer audio.Close()
+
+  // Build the multipart body
+  var form bytes.Buffer
+  writer := multipart.NewWriter(&form)
+  part, err := writer.CreateFormFile("file", file.Filename)
+  if err != nil {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error creating multipart body")
+  }
+  if _, err := io.Copy(part, audio); err != nil {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error creating multipart body")
+  }
+  writer.WriteField("model", model)
+  writer.WriteField("response_format", "verbose_json")
+  if language != "" {
+    writer.WriteField("language", language)
+  }
+  if err := writer.Close(); err != nil {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error creating multipart body")
+  }
+
+  // Make HTTP request
+  req, err := http.NewRequest("POST", url, &form)
+  if err != nil {
+    return nil, http.StatusInternalServerError, fiber.NewError(fiber.StatusInternalServerError, "Error creating request")
+  }
+
+  // Add headers
+  req.Header.Set("Content-Type", writer.FormDataContentType())
+
+  // Send request
+  return upstreamCall(ctx, "openai", req)
+}
+
 func WhisperHandler(c *fiber.Ctx) error {
-  return c.SendString("Still working on this route\nWhisper Handler")
+  // Read form fields
+  userID := requestUserID(c, c.FormValue("id_user"))
+  model := c.FormValue("model", "whisper-1")
+  language := c.FormValue("language")
+  responseFormat := c.FormValue("response_format", "json")
+
+  switch responseFormat {
+  case "json", "text", "srt", "vtt", "verbose_json":
+  default:
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "response_format must be one of json, text, srt, vtt or verbose_json",
+    })
+  }
+
+  file, err := c.FormFile("file")
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": "file is required",
+    })
+  }
+
+  // Get model price from models.json
+  price, err := getModelAudioPrice(model, "openai")
+  if err != nil {
+    return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+      "error": fmt.Sprintf("Model %s is not available for openai", model),
+    })
+  }
+
+  // Check if the user exists before spending on the upstream call
+  user, err := findUser(userID)
+  if err != nil {
+    return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+      "error": "User not found",
+    })
+  }
+
+  // The duration is unknown until Whisper answers, so only block spent budgets
+  if rejected, err := enforceBudget(c, user, "openai", model, 0); rejected {
+    return err
+  }
+
+  // Fail fast while the provider or model is known to be down
+  if !breakerAllow("openai", model) {
+    return breakerOpenResponse(c, completionTarget{Company: "openai", Model: model})
+  }
+
+  // Make openai' request
+  ctx, tracker := withKeyTracker(requestContext(c))
+  response, statusCode, err := WhisperResponseJSON(ctx, file, model, language)
+  breakerReport("openai", model, statusCode, err)
+  if err != nil {
+    return c.Status(statusCode).JSON(fiber.Map{
+      "error": err.Error(),
+    })
+  }
+
+  // If request is not successful, don't update the database
+  if statusCode != http.StatusOK {
+    return c.Status(statusCode).Send(response)
+  }
+
+  var transcription WhisperResponse
+  if err := json.Unmarshal(response, &transcription); err != nil {
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error parsing response JSON",
+    })
+  }
+
+  if err := recordAudioUsage(userID, "openai", model, tracker.Label(), transcription.Duration, price); err != nil {
+    log.Printf("%v", err)
+    return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+      "error": "Error updating MongoDB",
+    })
+  }
+
+  // Return response in the requested format
+  switch responseFormat {
+  case "text":
+    return c.SendString(transcription.Text)
+  case "srt":
+    c.Set("Content-Type", "application/x-subrip")
+    return c.SendString(formatSubtitles(transcription.Segments, false))
+  case "vtt":
+    c.Set("Content-Type", "text/vtt")
+    return c.SendString(formatSubtitles(transcription.Segments, true))
+  case "verbose_json":
+    c.Set("Content-Type", "application/json")
+    return c.Send(response)
+  default:
+    return c.JSON(fiber.Map{
+      "text": transcription.Text,
+    })
+  }
+}
+
+// Helper function to look up a model's current per-minute price in the catalog
+func getModelAudioPrice(model string, company string) (ModelPrice, error) {
+  spec, exists := currentCatalog().Model(company, model)
+  if !exists || spec.PricePerMinute <= 0 {
+    log.Printf("Audio model %s not found in company %s", model, company)
+    return ModelPrice{}, fmt.Errorf("audio model not found")
+  }
+
+  return spec.PriceAt(time.Now()), nil
+}
+
+// recordAudioUsage bills the transcribed seconds to the user's aggregates and usage events
+func recordAudioUsage(userID string, company string, model string, keyLabel string, seconds float64, price ModelPrice) error {
+  // Calculate usage
+  inputUsage := seconds * (price.PerMinute / 60)
+
+  // Update MongoDB
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+  defer cancel()
+
+  filter := bson.M{"id_user": userID}
+
+  modelKey := usageModelKey(company, model)
+
+  inc := bson.M{
+    "input_usage": inputUsage,
+    company + ".input_usage": inputUsage,
+    modelKey + ".audio_seconds": seconds,
+    modelKey + ".input_usage": inputUsage,
+  }
+  addMonthlySpend(inc, currentMonth(), company, model, inputUsage)
+
+  update := bson.M{"$inc": inc}
+  opts := options.Update().SetUpsert(false)
+  if _, err := userCollection.UpdateOne(ctx, filter, update, opts); err != nil {
+    return err
+  }
+
+  return recordEvent(History{
+    UserID: userID,
+    Company: company,
+    Model: model,
+    AudioSeconds: seconds,
+    InputUsage: inputUsage,
+    PriceVersion: price.Version,
+    APIKey: keyLabel,
+  })
+}
+
+// formatSubtitles renders the segments as SRT, or as WebVTT when vtt is set
+func formatSubtitles(segments []WhisperSegment, vtt bool) string {
+  var builder strings.Builder
+  if vtt {
+    builder.WriteString("WEBVTT\n\n")
+  }
+  for i, segment := range segments {
+    if !vtt {
+      fmt.Fprintf(&builder, "%d\n", i+1)
+    }
+    fmt.Fprintf(&builder, "%s --> %s\n%s\n\n", formatTimestamp(segment.Start, vtt), formatTimestamp(segment.End, vtt), strings.TrimSpace(segment.Text))
+  }
+  return builder.String()
+}
+
+func formatTimestamp(seconds float64, vtt bool) string {
+  millis := int64(seconds*1000 + 0.5)
+  separator := ","
+  if vtt {
+    separator = "."
+  }
+  return fmt.Sprintf("%02d:%02d:%02d%s%03d", millis/3600000, millis/60000%60, millis/1000%60, separator, millis%1000)
 }
@@ -2,9 +2,11 @@ package main
 
 import (
   "context"
+  "flag"
   "log"
   "time"
   "os"
+  "strconv"
 
   "github.com/gofiber/fiber/v2"
   "github.com/gofiber/fiber/v2/middleware/logger"
@@ -15,8 +17,20 @@ import (
 )
 
 var userCollection *mongo.Collection
+var usageCollection *mongo.Collection
+var modelsCollection *mongo.Collection
+var modelAuditCollection *mongo.Collection
 
 func main() {
+  migrateHistory := flag.Bool("migrate-history", false, "move embedded user history into usage_events and exit")
+  recalculateUsage := flag.Bool("recalculate-usage", false, "reprice usage_events with the prices effective when they were made and exit")
+  recalculateFrom := flag.String("from", "", "first day (YYYY-MM-DD) or RFC 3339 time to recalculate")
+  recalculateTo := flag.String("to", "", "last day (YYYY-MM-DD) or RFC 3339 time to recalculate")
+  recalculateCompany := flag.String("company", "", "only recalculate this company's events")
+  recalculateModel := flag.String("model", "", "only recalculate this model's events")
+  dryRun := flag.Bool("dry-run", false, "report what -recalculate-usage would change without writing")
+  flag.Parse()
+
   // MongoDB config
   ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
   defer cancel()
@@ -31,31 +45,102 @@ func main() {
   defer client.Disconnect(ctx)
 
   userCollection = client.Database("autogpt").Collection("users")
+  usageCollection = client.Database("autogpt").Collection("usage_events")
+  modelsCollection = client.Database("autogpt").Collection("models")
+  modelAuditCollection = client.Database("autogpt").Collection("model_audit")
+
+  // Days to keep usage events, unset or 0 keeps them forever
+  retentionDays, _ := strconv.Atoi(os.Getenv("USAGE_RETENTION_DAYS"))
+
+  // Pass collections to handlers
+  handlers.InitHandlers(userCollection, usageCollection, modelsCollection, modelAuditCollection, retentionDays)
+
+  // The server doesn't start without a valid model catalog, models.json
+  // seeds the models collection on first start
+  if err := handlers.LoadModelCatalog(); err != nil {
+    log.Fatal("Error loading model catalog: ", err)
+  }
+
+  if *migrateHistory {
+    migrateCtx, migrateCancel := context.WithTimeout(context.Background(), time.Hour)
+    defer migrateCancel()
+
+    users, events, err := handlers.MigrateHistory(migrateCtx)
+    if err != nil {
+      log.Fatal("Error migrating history: ", err)
+    }
+    log.Printf("Migrated %d history entries from %d users", events, users)
+    return
+  }
+
+  if *recalculateUsage {
+    recalculateCtx, recalculateCancel := context.WithTimeout(context.Background(), time.Hour)
+    defer recalculateCancel()
+
+    result, err := handlers.RecalculateUsage(recalculateCtx, *recalculateFrom, *recalculateTo, *recalculateCompany, *recalculateModel, *dryRun)
+    if err != nil {
+      log.Fatal("Error recalculating usage: ", err)
+    }
+    verb := "Repriced"
+    if *dryRun {
+      verb = "Would reprice"
+    }
+    log.Printf("%s %d of %d events (%d skipped), total change %+.6f USD", verb, result.Changed, result.Events, result.Skipped, result.Delta)
+    return
+  }
+
+  // Pick up models.json edits and SIGHUP without a restart
+  go handlers.WatchModelCatalog(5 * time.Second)
 
   // Init new fiber custom app
+  // A single process serves every request, so circuit breakers, key pool
+  // cooldowns and SIGHUP reloads apply to all of them
   app := fiber.New(fiber.Config{
-    Prefork: true,
     CaseSensitive: true,
     ServerHeader: "Fiber",
     AppName: "autoGPT API v1.1.0",
+    // Whisper accepts audio uploads of up to 25 MB
+    BodyLimit: 25 * 1024 * 1024,
   })
   
   // Middleware to log requests
   app.Use(logger.New())
 
-  // Pass userCollection to handlers
-  handlers.InitHandlers(userCollection)
-
   // Routes
   app.Get("/", func(c *fiber.Ctx) error {
     return c.SendString("Hello World")
   })
   
-  app.Get("/brain", handlers.OpenAIBrain)
-  app.Post("/openai", handlers.OpenAIHandler)
-  app.Post("/google", handlers.GoogleHandler)
-  app.Post("/anthropic", handlers.AnthropicHandler)
-  app.Get("/whisper", handlers.WhisperHandler)
+  app.Get("/status", handlers.StatusHandler)
+  app.Get("/models", handlers.ModelsHandler)
+  app.Get("/models/:company/:model", handlers.ModelHandler)
+  app.Post("/brain", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.BrainHandler)
+  app.Post("/openai", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.ProviderHandler("openai"))
+  app.Post("/google", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.ProviderHandler("google"))
+  app.Post("/anthropic", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.ProviderHandler("anthropic"))
+  app.Post("/whisper", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.WhisperHandler)
+  app.Post("/embeddings", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.EmbeddingsHandler)
+
+  // OpenAI compatible API
+  app.Post("/v1/chat/completions", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.ChatCompletionsHandler)
+  app.Post("/v1/embeddings", handlers.UserAuth, handlers.CancelOnDisconnect, handlers.EmbeddingsHandler)
+
+  // Usage reports, for the user itself or an admin
+  app.Get("/users/:id/usage", handlers.UserAuth, handlers.UsageReportHandler)
+  app.Get("/users/:id/history", handlers.UserAuth, handlers.HistoryHandler)
+
+  // Admin routes
+  admin := app.Group("/admin", handlers.AdminAuth)
+  admin.Get("/diagnostics", handlers.DiagnosticsHandler)
+  admin.Post("/users/:id/keys", handlers.CreateAPIKeyHandler)
+  admin.Delete("/users/:id/keys/:prefix", handlers.RevokeAPIKeyHandler)
+  admin.Get("/users/:id/budget", handlers.GetBudgetHandler)
+  admin.Put("/users/:id/budget", handlers.SetBudgetHandler)
+  admin.Get("/models", handlers.ListStoredModelsHandler)
+  admin.Post("/models/:company/:model", handlers.CreateModelHandler)
+  admin.Put("/models/:company/:model", handlers.UpdateModelHandler)
+  admin.Delete("/models/:company/:model", handlers.RetireModelHandler)
+  admin.Get("/models/:company/:model/audit", handlers.ModelAuditHandler)
 
   // Init server
   port := "8080"